@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// The templates and the files served under /assets/ are compiled into the
+// binary, so the server can be started from any working directory.
+//
+//go:embed *.html
+var embeddedTemplates embed.FS
+
+//go:embed static
+var embeddedStatic embed.FS
+
+// overlayFS opens files from an override directory when they exist there and
+// falls back to the embedded copies otherwise, so a host can customise a
+// single template or stylesheet without replacing the rest.
+type overlayFS struct {
+	override fs.FS
+	base     fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if o.override != nil {
+		if file, err := o.override.Open(name); err == nil {
+			return file, nil
+		}
+	}
+	return o.base.Open(name)
+}
+
+func withOverride(base fs.FS, dir string) fs.FS {
+	if dir == "" {
+		return base
+	}
+	return overlayFS{override: os.DirFS(dir), base: base}
+}
+
+func templateFS() fs.FS {
+	return withOverride(embeddedTemplates, config.TemplateDir)
+}
+
+func staticFS() fs.FS {
+	static, err := fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		panic(err)
+	}
+	return withOverride(static, config.StaticDir)
+}
+
+// The vendored Bootstrap files are fetched by fetch-bootstrap.sh, which checks
+// them against the same hashes the CDN links used.
+var vendoredAssets = [2]string{
+	"vendor/bootstrap/bootstrap.min.css",
+	"vendor/bootstrap/bootstrap.bundle.min.js",
+}
+
+func checkVendoredAssets() {
+	for _, name := range vendoredAssets {
+		if _, err := fs.Stat(staticFS(), name); err != nil {
+			slog.Warn("missing vendored asset, run ./fetch-bootstrap.sh and rebuild to style the pages", "asset", name)
+		}
+	}
+}
+
+var fingerprints = map[string]string{}
+var fingerprintsLock sync.Mutex
+
+// assetPath returns the URL for a file under /assets/ with a hash of its
+// content in the name, such as /assets/site.0f3a9c21d4.css, so it can be
+// cached for a long time and still change when the file does.
+func assetPath(name string) string {
+	fingerprintsLock.Lock()
+	defer fingerprintsLock.Unlock()
+	if url, ok := fingerprints[name]; ok {
+		return url
+	}
+	url := "/assets/" + name
+	if data, err := fs.ReadFile(staticFS(), name); err == nil {
+		sum := sha256.Sum256(data)
+		ext := path.Ext(name)
+		url = fmt.Sprintf("/assets/%v.%v%v", strings.TrimSuffix(name, ext), hex.EncodeToString(sum[:5]), ext)
+	}
+	fingerprints[name] = url
+	return url
+}
+
+// resetFingerprints forgets the cached hashes when templates are reloaded,
+// which is when a host editing files in dev mode expects to see changes.
+func resetFingerprints() {
+	fingerprintsLock.Lock()
+	defer fingerprintsLock.Unlock()
+	fingerprints = map[string]string{}
+}
+
+var fingerprinted = regexp.MustCompile(`^(.+)\.[0-9a-f]{10}(\.[^./]+)$`)
+
+// assetHandler serves files from staticFS. Requests for the current
+// fingerprinted name are cached for a year; anything else, including an
+// outdated fingerprint, must be revalidated.
+func assetHandler() http.Handler {
+	fileServer := http.FileServer(http.FS(staticFS()))
+	return http.StripPrefix("/assets", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		name := strings.TrimPrefix(request.URL.Path, "/")
+		if match := fingerprinted.FindStringSubmatch(name); match != nil {
+			original := match[1] + match[2]
+			if "/assets/"+name == assetPath(original) {
+				writer.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+			} else {
+				writer.Header().Set("Cache-Control", "no-cache")
+			}
+			request.URL.Path = "/" + original
+		} else {
+			writer.Header().Set("Cache-Control", "no-cache")
+		}
+		fileServer.ServeHTTP(writer, request)
+	}))
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The audit log records every change to a response in audit.jsonl in the
+// data directory, one JSON entry per line. Entries are only ever appended,
+// and each one includes the hash of the one before it, so an entry that was
+// edited or removed later breaks the chain and shows up on the audit page.
+// The one exception is eraseAudit, which rewrites the log when a guest asks
+// for their data to be deleted or the retention period is over.
+type auditEntry struct {
+	Time      time.Time     `json:"time"`
+	Action    string        `json:"action"`
+	Actor     string        `json:"actor"`
+	IP        string        `json:"ip,omitempty"`
+	Name      string        `json:"name"`
+	Email     string        `json:"email"`
+	Household string        `json:"household,omitempty"`
+	Changes   []fieldChange `json:"changes"`
+	Prev      string        `json:"prev"`
+	Hash      string        `json:"hash"`
+}
+
+type fieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+const (
+	auditCreate  = "create"
+	auditUpdate  = "update"
+	auditCancel  = "cancel"
+	auditPromote = "promote"
+	auditRemove  = "remove"
+	auditErase   = "erase"
+)
+
+// erased replaces personal data that a guest asked to have deleted.
+const erased = "[erased]"
+
+// An auditSource says who made a change and from where.
+type auditSource struct {
+	Actor, IP string
+}
+
+// guestSource is a guest answering on the site, who may answer for their
+// whole household.
+func guestSource(request *http.Request, email string) auditSource {
+	return auditSource{Actor: "guest:" + email, IP: clientIP(request)}
+}
+
+var systemSource = auditSource{Actor: "system"}
+
+// adminSource names the user running a command line tool.
+func adminSource() auditSource {
+	name := os.Getenv("USER")
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	return auditSource{Actor: "admin:" + name}
+}
+
+func auditPath() string {
+	return filepath.Join(config.DataDir, "audit.jsonl")
+}
+
+func rsvpFields(rsvp *Rsvp) [][2]string {
+	if rsvp == nil {
+		rsvp = &Rsvp{}
+	}
+	return [][2]string{
+		{"name", rsvp.Name}, {"email", rsvp.Email}, {"phone", rsvp.Phone},
+		{"household", rsvp.Household}, {"attending", strconv.FormatBool(rsvp.WillAttend)},
+		{"waitlisted", strconv.FormatBool(rsvp.Waitlisted)}, {"plusOnes", strconv.Itoa(rsvp.PlusOnes)},
+	}
+}
+
+// rsvpChanges lists the fields that differ between two versions of a
+// response. Either may be nil for a response that is created or removed.
+func rsvpChanges(old, new *Rsvp) []fieldChange {
+	changes := []fieldChange{}
+	oldFields, newFields := rsvpFields(old), rsvpFields(new)
+	for i := range oldFields {
+		if oldFields[i][1] != newFields[i][1] || (old == nil && newFields[i][1] != "") {
+			changes = append(changes, fieldChange{Field: oldFields[i][0], Old: oldFields[i][1], New: newFields[i][1]})
+		}
+	}
+	return changes
+}
+
+// auditAction describes a change from old to new, where a guest who was
+// coming and no longer is has cancelled.
+func auditAction(old, new *Rsvp) string {
+	if old == nil {
+		return auditCreate
+	} else if new == nil {
+		return auditRemove
+	} else if old.WillAttend && !new.WillAttend {
+		return auditCancel
+	}
+	return auditUpdate
+}
+
+// recordChange appends an audit entry for a change from old to new, using
+// auditAction unless action is given. The caller must hold the store, which
+// keeps the chain in order between the server and the command line tools.
+// A failure is logged, since the change itself has already been saved.
+func recordChange(source auditSource, action string, old, new *Rsvp) {
+	guest := new
+	if guest == nil {
+		guest = old
+	}
+	if action == "" {
+		action = auditAction(old, new)
+	}
+	entry := auditEntry{
+		Time: time.Now().UTC(), Action: action, Actor: source.Actor, IP: source.IP,
+		Name: guest.Name, Email: guest.Email, Household: guest.Household,
+		Changes: rsvpChanges(old, new),
+	}
+	if err := appendAudit(entry); err != nil {
+		slog.Error("failed to write audit entry", "email", entry.Email, "action", action, "error", err)
+	}
+}
+
+func (e auditEntry) computeHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// appendAudit adds an entry to the end of the log, linked to the last one.
+// Only the end of the file is read, so appending does not get slower as the
+// log grows. A last line without a newline was cut off while it was being
+// written, for instance by a crash, and is replaced.
+func appendAudit(entry auditEntry) error {
+	file, err := os.OpenFile(auditPath(), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	last, end, err := lastAuditLine(file, info.Size())
+	if err != nil {
+		return err
+	}
+	if len(last) > 0 {
+		previous := auditEntry{}
+		if err := json.Unmarshal(last, &previous); err != nil {
+			return fmt.Errorf("last audit log entry: %w", err)
+		}
+		entry.Prev = previous.Hash
+	}
+	if end < info.Size() {
+		slog.Warn("replacing an incomplete last line in the audit log", "path", auditPath(), "bytes", info.Size()-end)
+		if err := file.Truncate(end); err != nil {
+			return err
+		}
+	}
+	entry.Hash = entry.computeHash()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(append(line, '\n'), end); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// lastAuditLine reads the log backwards from its end to find the last
+// complete line. It returns that line without its newline and the offset
+// just after it, which is where the next entry goes.
+func lastAuditLine(file *os.File, size int64) ([]byte, int64, error) {
+	tail := []byte{}
+	end := int64(-1)
+	for pos := size; pos > 0; {
+		n := min(pos, 4096)
+		pos -= n
+		chunk := make([]byte, n)
+		if _, err := file.ReadAt(chunk, pos); err != nil {
+			return nil, 0, err
+		}
+		tail = append(chunk, tail...)
+		if end < 0 {
+			if i := bytes.LastIndexByte(tail, '\n'); i >= 0 {
+				end = pos + int64(i) + 1
+			}
+		}
+		if end >= 0 {
+			line := tail[:end-1-pos]
+			if i := bytes.LastIndexByte(line, '\n'); i >= 0 {
+				return line[i+1:], end, nil
+			} else if pos == 0 {
+				return line, end, nil
+			}
+		}
+	}
+	return nil, 0, nil
+}
+
+func readAudit() ([]auditEntry, error) {
+	data, err := os.ReadFile(auditPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parseAudit(data)
+}
+
+// parseAudit reads the entries in a log. A last line without a newline was
+// cut off while it was being written and is left out, as appendAudit will
+// replace it.
+func parseAudit(data []byte) ([]auditEntry, error) {
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+	entries := []auditEntry{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		entry := auditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return entries, fmt.Errorf("audit log line %v: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// verifyAudit returns the position of the first entry whose hash or link to
+// the entry before it is wrong, or -1 if the chain is intact.
+func verifyAudit(entries []auditEntry) int {
+	prev := ""
+	for i, entry := range entries {
+		if entry.Prev != prev || entry.Hash != entry.computeHash() {
+			return i
+		}
+		prev = entry.Hash
+	}
+	return -1
+}
+
+func auditFor(entries []auditEntry, email string) []auditEntry {
+	if email == "" {
+		return entries
+	}
+	matching := []auditEntry{}
+	for _, entry := range entries {
+		if strings.EqualFold(entry.Email, email) {
+			matching = append(matching, entry)
+		}
+	}
+	return matching
+}
+
+// auditMentions reports whether an entry is about a guest or was made by
+// them, for instance for another member of their household.
+func auditMentions(entry auditEntry, email string) bool {
+	return strings.EqualFold(entry.Email, email) || strings.EqualFold(entry.Actor, "guest:"+email)
+}
+
+// eraseAudit replaces the personal data in the entries that mention any of
+// the guests, whose email addresses are given in lower case, and adds an
+// entry from source saying how many were erased. The hashes are worked out
+// again so the chain stays intact, unless it was already broken, which must
+// stay visible. The caller must hold the store.
+func eraseAudit(emails map[string]bool, source auditSource) error {
+	entries, err := readAudit()
+	if err != nil {
+		return err
+	}
+	intact := verifyAudit(entries) < 0
+	count := 0
+	for i, entry := range entries {
+		actor := strings.ToLower(strings.TrimPrefix(entry.Actor, "guest:"))
+		byGuest := strings.HasPrefix(entry.Actor, "guest:") && emails[actor]
+		if !byGuest && !emails[strings.ToLower(entry.Email)] {
+			continue
+		}
+		count++
+		if byGuest {
+			entry.Actor = "guest:" + erased
+			entry.IP = ""
+		}
+		if emails[strings.ToLower(entry.Email)] {
+			entry.Name, entry.Email, entry.Household = erased, erased, ""
+			for j, change := range entry.Changes {
+				if change.Field == "name" || change.Field == "email" || change.Field == "phone" || change.Field == "household" {
+					entry.Changes[j] = fieldChange{Field: change.Field, Old: eraseValue(change.Old), New: eraseValue(change.New)}
+				}
+			}
+		}
+		entries[i] = entry
+	}
+	if count == 0 {
+		return nil
+	}
+	if intact {
+		prev := ""
+		for i := range entries {
+			entries[i].Prev = prev
+			entries[i].Hash = entries[i].computeHash()
+			prev = entries[i].Hash
+		}
+	}
+	var buffer bytes.Buffer
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buffer.Write(append(line, '\n'))
+	}
+	file, err := os.CreateTemp(config.DataDir, "audit-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(buffer.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), auditPath()); err != nil {
+		return err
+	}
+	return appendAudit(auditEntry{
+		Time: time.Now().UTC(), Action: auditErase, Actor: source.Actor, IP: source.IP, Name: erased, Email: erased,
+		Changes: []fieldChange{{Field: "entries", New: strconv.Itoa(count)}},
+	})
+}
+
+func eraseValue(value string) string {
+	if value == "" {
+		return ""
+	}
+	return erased
+}
+
+type auditData struct {
+	Email      string
+	Entries    []auditEntry
+	BrokenAt   int
+	ExportCSV  string
+	ExportJSON string
+}
+
+// auditHandler shows the audit trail for one guest, or for everyone, with
+// the newest changes first.
+func auditHandler(writer http.ResponseWriter, request *http.Request) {
+	lockStore()
+	entries, err := readAudit()
+	unlockStore()
+	if err != nil {
+		loggerFor(request).Error("failed to read audit log", "error", err)
+		showError(writer, request, http.StatusInternalServerError, "error.audit")
+		return
+	}
+	email := strings.TrimSpace(request.FormValue("email"))
+	data := auditData{Email: email, BrokenAt: verifyAudit(entries)}
+	for _, entry := range auditFor(entries, email) {
+		data.Entries = append([]auditEntry{entry}, data.Entries...)
+	}
+	for _, format := range [2]string{"csv", "json"} {
+		query := url.Values{"format": {format}}
+		if email != "" {
+			query.Set("email", email)
+		}
+		if format == "csv" {
+			data.ExportCSV = "/host/audit/export?" + query.Encode()
+		} else {
+			data.ExportJSON = "/host/audit/export?" + query.Encode()
+		}
+	}
+	if data.BrokenAt >= 0 {
+		data.BrokenAt++
+	}
+	renderTemplate(writer, request, http.StatusOK, "audit", data)
+}
+
+// auditExportHandler downloads the audit trail as CSV, with one row per
+// changed field, or as the JSON entries including their hashes.
+func auditExportHandler(writer http.ResponseWriter, request *http.Request) {
+	lockStore()
+	entries, err := readAudit()
+	unlockStore()
+	if err != nil {
+		loggerFor(request).Error("failed to read audit log", "error", err)
+		showError(writer, request, http.StatusInternalServerError, "error.audit")
+		return
+	}
+	entries = auditFor(entries, strings.TrimSpace(request.FormValue("email")))
+	name := "audit-" + time.Now().Format("20060102")
+	if request.FormValue("format") == "json" {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Header().Set("Content-Disposition", `attachment; filename="`+name+`.json"`)
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(entries)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	writer.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+	records := csv.NewWriter(writer)
+	records.Write([]string{"time", "action", "actor", "ip", "name", "email", "household", "field", "old", "new"})
+	for _, entry := range entries {
+		row := []string{entry.Time.Format(time.RFC3339), entry.Action, entry.Actor, entry.IP, entry.Name, entry.Email, entry.Household}
+		if len(entry.Changes) == 0 {
+			records.Write(append(row, "", "", ""))
+		}
+		for _, change := range entry.Changes {
+			records.Write(append(row, change.Field, change.Old, change.New))
+		}
+	}
+	records.Flush()
+}
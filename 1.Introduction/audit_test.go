@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAppendAuditRepairsIncompleteLine(t *testing.T) {
+	config.DataDir = t.TempDir()
+	names := []string{"Ann", strings.Repeat("B", 5000), "Cid"}
+	for _, name := range names {
+		if err := appendAudit(auditEntry{Action: "create", Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file, err := os.OpenFile(auditPath(), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"action":"create","name":"Dee`)
+	file.Close()
+
+	entries, err := readAudit()
+	if err != nil {
+		t.Fatalf("reading a log with an incomplete last line: %v", err)
+	}
+	if len(entries) != len(names) {
+		t.Fatalf("read %v entries, want %v", len(entries), len(names))
+	}
+
+	if err := appendAudit(auditEntry{Action: "create", Name: "Eve"}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = readAudit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(names)+1 || entries[len(entries)-1].Name != "Eve" {
+		t.Fatalf("the incomplete line was not replaced: %+v", entries)
+	}
+	if broken := verifyAudit(entries); broken >= 0 {
+		t.Errorf("chain broken at entry %v", broken)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A backup is a gzipped tar file with manifest.json first, followed by the
+// files from the data directory that the manifest lists with their sizes and
+// SHA-256 hashes. The version is raised whenever the layout changes, so an
+// older binary refuses an archive it would misread.
+const (
+	backupFormat  = "partyinvites-backup"
+	backupVersion = 2
+	manifestName  = "manifest.json"
+)
+
+type backupManifest struct {
+	Format  string       `json:"format"`
+	Version int          `json:"version"`
+	Created time.Time    `json:"created"`
+	Event   string       `json:"event"`
+	Files   []backupFile `json:"files"`
+}
+
+type backupFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type backup struct {
+	Manifest backupManifest
+	Files    map[string][]byte
+	Store    storeData
+}
+
+func (b backup) summary() string {
+	images := 0
+	for name := range b.Files {
+		if strings.HasPrefix(name, "theme/") {
+			images++
+		}
+	}
+	return fmt.Sprintf("%v invitations, %v responses and %v theme images",
+		len(b.Store.Invitations), len(b.Store.Responses), images)
+}
+
+// backupName accepts the store, the audit log and the theme images, and
+// nothing that could be written outside the data directory on restore.
+// Version 1 archives have no audit log.
+func backupName(name string) bool {
+	dir, file := path.Split(name)
+	return name == "rsvps.json" || name == "audit.jsonl" || (dir == "theme/" && themeImageName.MatchString(file))
+}
+
+// snapshot reads the data directory while the server may be writing to it.
+// The store is replaced by renaming, so reading it gives a consistent copy,
+// and it is read before the audit log and the theme images, which are written
+// before any store that refers to them. The audit log is only appended to, so
+// a copy may end with a partial line, which is left out.
+func snapshot() (backup, error) {
+	b := backup{
+		Manifest: backupManifest{Format: backupFormat, Version: backupVersion, Created: time.Now().UTC().Truncate(time.Second), Event: config.Event.Name},
+		Files:    map[string][]byte{},
+	}
+	data, err := os.ReadFile(storePath())
+	if errors.Is(err, os.ErrNotExist) {
+		data, err = json.Marshal(storeData{})
+	}
+	if err != nil {
+		return b, err
+	}
+	if err := json.Unmarshal(data, &b.Store); err != nil {
+		return b, fmt.Errorf("%v: %w", storePath(), err)
+	}
+	b.Files["rsvps.json"] = data
+	audit, err := os.ReadFile(auditPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return b, err
+	} else if err == nil {
+		b.Files["audit.jsonl"] = audit[:bytes.LastIndexByte(audit, '\n')+1]
+	}
+	images, err := os.ReadDir(themeDir())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return b, err
+	}
+	for _, image := range images {
+		if !themeImageName.MatchString(image.Name()) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(themeDir(), image.Name()))
+		if err != nil {
+			return b, err
+		}
+		b.Files["theme/"+image.Name()] = data
+	}
+	names := make([]string, 0, len(b.Files))
+	for name := range b.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sum := sha256.Sum256(b.Files[name])
+		b.Manifest.Files = append(b.Manifest.Files, backupFile{
+			Name: name, Size: int64(len(b.Files[name])), SHA256: hex.EncodeToString(sum[:]),
+		})
+	}
+	return b, nil
+}
+
+// writeArchive writes the backup to a temporary file next to target and
+// renames it into place once it is complete.
+func writeArchive(b backup, target string) error {
+	file, err := os.CreateTemp(filepath.Dir(target), ".partyinvites-backup-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	compressed := gzip.NewWriter(file)
+	archive := tar.NewWriter(compressed)
+	manifest, err := json.MarshalIndent(b.Manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	entries := append([]backupFile{{Name: manifestName}}, b.Manifest.Files...)
+	for _, entry := range entries {
+		data := b.Files[entry.Name]
+		if entry.Name == manifestName {
+			data = manifest
+		}
+		header := &tar.Header{Name: entry.Name, Mode: 0o644, Size: int64(len(data)), ModTime: b.Manifest.Created}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := archive.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	if err := compressed.Close(); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), target)
+}
+
+const maxBackupFile = 64 << 20
+
+// readArchive reads a backup and checks it completely: the format and
+// version, every file against the manifest, and that the store decodes.
+func readArchive(name string) (backup, error) {
+	b := backup{Files: map[string][]byte{}}
+	file, err := os.Open(name)
+	if err != nil {
+		return b, err
+	}
+	defer file.Close()
+	compressed, err := gzip.NewReader(file)
+	if err != nil {
+		return b, fmt.Errorf("not a backup archive: %w", err)
+	}
+	archive := tar.NewReader(compressed)
+	for first := true; ; first = false {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return b, fmt.Errorf("archive is damaged: %w", err)
+		}
+		if header.Typeflag == tar.TypeDir && !first {
+			continue
+		} else if header.Typeflag != tar.TypeReg {
+			return b, fmt.Errorf("unexpected entry %q in archive", header.Name)
+		}
+		if header.Size > maxBackupFile {
+			return b, fmt.Errorf("%v is too large", header.Name)
+		}
+		data, err := io.ReadAll(archive)
+		if err != nil {
+			return b, fmt.Errorf("archive is damaged: %w", err)
+		}
+		if first {
+			if header.Name != manifestName {
+				return b, fmt.Errorf("archive does not start with %v", manifestName)
+			}
+			if err := json.Unmarshal(data, &b.Manifest); err != nil {
+				return b, fmt.Errorf("%v: %w", manifestName, err)
+			}
+			if b.Manifest.Format != backupFormat {
+				return b, fmt.Errorf("not a partyinvites backup")
+			} else if b.Manifest.Version > backupVersion {
+				return b, fmt.Errorf("backup version %v is newer than this program supports (%v)", b.Manifest.Version, backupVersion)
+			}
+			continue
+		}
+		if !backupName(header.Name) {
+			return b, fmt.Errorf("unexpected file %q in archive", header.Name)
+		}
+		b.Files[header.Name] = data
+	}
+	if b.Manifest.Format == "" {
+		return b, fmt.Errorf("archive is empty")
+	}
+	problems := []string{}
+	listed := map[string]bool{}
+	for _, entry := range b.Manifest.Files {
+		listed[entry.Name] = true
+		data, ok := b.Files[entry.Name]
+		sum := sha256.Sum256(data)
+		if !ok {
+			problems = append(problems, entry.Name+" is missing")
+		} else if int64(len(data)) != entry.Size || hex.EncodeToString(sum[:]) != entry.SHA256 {
+			problems = append(problems, entry.Name+" does not match its checksum")
+		}
+	}
+	for name := range b.Files {
+		if !listed[name] {
+			problems = append(problems, name+" is not listed in the manifest")
+		}
+	}
+	if _, ok := b.Files["rsvps.json"]; !ok {
+		problems = append(problems, "rsvps.json is missing")
+	} else if err := json.Unmarshal(b.Files["rsvps.json"], &b.Store); err != nil {
+		problems = append(problems, fmt.Sprintf("rsvps.json cannot be read: %v", err))
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return b, errors.New("backup is not valid:\n  " + strings.Join(problems, "\n  "))
+	}
+	return b, nil
+}
+
+// restoreArchive writes a verified backup into an empty data directory. The
+// store is written last, so an interrupted restore is not mistaken for a
+// complete one.
+func restoreArchive(b backup, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	} else if len(entries) > 0 {
+		return fmt.Errorf("data directory %v is not empty; restore into a new directory instead", dir)
+	}
+	names := make([]string, 0, len(b.Files))
+	for name := range b.Files {
+		if name != "rsvps.json" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range append(names, "rsvps.json") {
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(b.Files[name])
+		if err == nil {
+			err = file.Sync()
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func backupCommand(args []string) error {
+	flags := flag.NewFlagSet("partyinvites backup", flag.ContinueOnError)
+	output := flags.String("o", "", "archive to write (default partyinvites-backup-<time>.tar.gz)")
+	cfg, err := loadConfig(flags, args)
+	if err != nil {
+		return err
+	}
+	config = cfg
+	if *output == "" {
+		*output = "partyinvites-backup-" + time.Now().UTC().Format("20060102-150405") + ".tar.gz"
+	}
+	b, err := snapshot()
+	if err != nil {
+		return err
+	}
+	if err := writeArchive(b, *output); err != nil {
+		return err
+	}
+	fmt.Printf("Backed up %v to %v\n", b.summary(), *output)
+	return nil
+}
+
+func verifyCommand(args []string) error {
+	flags := flag.NewFlagSet("partyinvites verify", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	} else if flags.NArg() != 1 {
+		return errors.New("usage: partyinvites verify archive")
+	}
+	b, err := readArchive(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%v is a valid version %v backup of %q from %v with %v\n", flags.Arg(0),
+		b.Manifest.Version, b.Manifest.Event, b.Manifest.Created.Format(time.RFC3339), b.summary())
+	return nil
+}
+
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("partyinvites restore", flag.ContinueOnError)
+	cfg, err := loadConfig(flags, args)
+	if err != nil {
+		return err
+	} else if flags.NArg() != 1 {
+		return errors.New("usage: partyinvites restore [-data-dir dir] archive")
+	}
+	config = cfg
+	b, err := readArchive(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := restoreArchive(b, config.DataDir); err != nil {
+		return err
+	}
+	fmt.Printf("Restored %v into %v\n", b.summary(), config.DataDir)
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestData fills a fresh data directory with a store, an audit log and
+// a theme image.
+func writeTestData(t *testing.T) {
+	t.Helper()
+	config.DataDir = t.TempDir()
+	store := `{"Invitations":[{"Name":"Ann","Email":"ann@example.org"}],"Responses":[{"Name":"Ann","Email":"ann@example.org","WillAttend":true}]}`
+	if err := os.WriteFile(storePath(), []byte(store), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendAudit(auditEntry{Action: "create", Name: "Ann", Email: "ann@example.org"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(themeDir(), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(themeDir(), "0123456789abcdef.png"), []byte("image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	writeTestData(t)
+	b, err := snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := writeArchive(b, archive); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readArchive(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read.Files) != 3 || len(read.Store.Responses) != 1 || read.Store.Responses[0].Name != "Ann" {
+		t.Fatalf("read back %v", read.summary())
+	}
+	restored := t.TempDir()
+	if err := restoreArchive(read, restored); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"rsvps.json", "audit.jsonl", "theme/0123456789abcdef.png"} {
+		original, err := os.ReadFile(filepath.Join(config.DataDir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		copied, err := os.ReadFile(filepath.Join(restored, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(original, copied) {
+			t.Errorf("%v differs after restoring", name)
+		}
+	}
+	if err := restoreArchive(read, restored); err == nil {
+		t.Error("restoring into a directory that is not empty succeeded")
+	}
+}
+
+func TestBackupTampered(t *testing.T) {
+	tests := map[string]struct {
+		change func(b *backup)
+		want   string
+	}{
+		"changed file": {
+			func(b *backup) {
+				b.Files["rsvps.json"] = bytes.Replace(b.Files["rsvps.json"], []byte("Ann"), []byte("Bob"), 1)
+			},
+			"rsvps.json does not match its checksum",
+		},
+		"missing file": {
+			func(b *backup) {
+				b.Manifest.Files = append(b.Manifest.Files, backupFile{Name: "theme/fedcba9876543210.png"})
+			},
+			"theme/fedcba9876543210.png",
+		},
+		"path outside the data directory": {
+			func(b *backup) {
+				b.Files["../rsvps.json"] = b.Files["rsvps.json"]
+				b.Manifest.Files = append(b.Manifest.Files, backupFile{Name: "../rsvps.json"})
+			},
+			`unexpected file "../rsvps.json"`,
+		},
+		"newer version": {
+			func(b *backup) { b.Manifest.Version = backupVersion + 1 },
+			"newer than this program supports",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			writeTestData(t)
+			b, err := snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.change(&b)
+			archive := filepath.Join(t.TempDir(), "backup.tar.gz")
+			if err := writeArchive(b, archive); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readArchive(archive); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("readArchive = %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestBackupNotAnArchive(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := os.WriteFile(name, []byte("not gzip"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readArchive(name); err == nil {
+		t.Error("readArchive accepted a file that is not an archive")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A broker fans RSVP changes out to every connected list page. Each client
+// gets a buffered channel; a client that falls too far behind is dropped and
+// the browser's EventSource reconnects and reloads the list.
+type broker struct {
+	mutex   sync.Mutex
+	clients map[chan []byte]bool
+	closed  bool
+}
+
+var rsvpBroker = &broker{clients: map[chan []byte]bool{}}
+
+func (b *broker) subscribe() chan []byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	client := make(chan []byte, 16)
+	if b.closed {
+		close(client)
+	} else {
+		b.clients[client] = true
+	}
+	return client
+}
+
+func (b *broker) unsubscribe(client chan []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.clients[client] {
+		delete(b.clients, client)
+		close(client)
+	}
+}
+
+// close disconnects every client so that streaming handlers return and the
+// server can shut down without waiting for browsers to go away.
+func (b *broker) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	for client := range b.clients {
+		delete(b.clients, client)
+		close(client)
+	}
+}
+
+func (b *broker) publish(message []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for client := range b.clients {
+		select {
+		case client <- message:
+		default:
+			delete(b.clients, client)
+			close(client)
+		}
+	}
+}
+
+// A listEvent is what the list page is sent about a changed group: the
+// guests who attend, with only the details the page shows. Anyone can open
+// the list, so nothing else about the responses may be in it.
+type listEvent struct {
+	Key       string      `json:"key"`
+	Household string      `json:"household"`
+	Attending int         `json:"attending"`
+	Guests    []listGuest `json:"guests"`
+}
+
+type listGuest struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Phone string `json:"phone"`
+}
+
+func newListEvent(group *listGroup) listEvent {
+	event := listEvent{Key: group.Key, Attending: group.Attending, Guests: []listGuest{}}
+	if group.Attending > 0 {
+		event.Household = group.Household
+	}
+	for _, rsvp := range group.Guests {
+		if rsvp.WillAttend && !rsvp.Waitlisted {
+			event.Guests = append(event.Guests, listGuest{Name: rsvp.Name, Email: rsvp.Email, Phone: rsvp.Phone})
+		}
+	}
+	return event
+}
+
+// publishGroup sends the current state of the list group containing the
+// changed response, which list.html uses to replace that group in place.
+func publishGroup(rsvp *Rsvp) {
+	for _, group := range groupByHousehold(responses) {
+		if group.Key == groupKey(rsvp) {
+			message, err := json.Marshal(newListEvent(group))
+			if err != nil {
+				slog.Error("failed to encode RSVP event", "error", err)
+				return
+			}
+			rsvpBroker.publish(message)
+			return
+		}
+	}
+}
+
+func eventsHandler(writer http.ResponseWriter, request *http.Request) {
+	// The stream outlives the server's write timeout, so the deadline is
+	// pushed back before every write instead.
+	controller := http.NewResponseController(writer)
+	if err := controller.SetWriteDeadline(time.Now().Add(time.Minute)); err != nil {
+		http.Error(writer, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	writer.WriteHeader(http.StatusOK)
+	// The router answers HEAD with the GET handler. Nothing written to a HEAD
+	// response is sent and no write fails, so the stream would never notice
+	// the client leaving and would hold the connection forever.
+	if request.Method == http.MethodHead {
+		return
+	}
+	controller.Flush()
+
+	client := rsvpBroker.subscribe()
+	defer rsvpBroker.unsubscribe(client)
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case message, open := <-client:
+			if !open {
+				return
+			}
+			controller.SetWriteDeadline(time.Now().Add(time.Minute))
+			fmt.Fprintf(writer, "event: rsvp\ndata: %s\n\n", message)
+			controller.Flush()
+		case <-keepAlive.C:
+			controller.SetWriteDeadline(time.Now().Add(time.Minute))
+			fmt.Fprint(writer, ": keep-alive\n\n")
+			controller.Flush()
+		}
+	}
+}
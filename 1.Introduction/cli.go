@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// commands are selected by the first argument. The commands that manage
+// guests use the same store as the server, and can be run while it is
+// running: lockStore waits for the request in progress, and the server
+// reloads the store before its next request.
+var commands = map[string]func(args []string) error{
+	"serve":   serveCommand,
+	"list":    listCommand,
+	"add":     addCommand,
+	"remove":  removeCommand,
+	"export":  exportCommand,
+	"stats":   statsCommand,
+	"backup":  backupCommand,
+	"verify":  verifyCommand,
+	"restore": restoreCommand,
+}
+
+var commandSummaries = [][2]string{
+	{"serve", "run the web server (the default)"},
+	{"list", "list guests and their answers"},
+	{"add", "add or update a guest's RSVP"},
+	{"remove", "remove a guest's RSVP and invitation"},
+	{"export", "write the guest list as CSV or JSON"},
+	{"stats", "show response and attendance numbers"},
+	{"backup", "write the data directory to an archive"},
+	{"verify", "check an archive written by backup"},
+	{"restore", "restore an archive into an empty data directory"},
+	{"help", "show this message"},
+}
+
+func printUsage(writer io.Writer) {
+	fmt.Fprintln(writer, "Usage: partyinvites [command] [flags] [arguments]\n\nCommands:")
+	for _, summary := range commandSummaries {
+		fmt.Fprintf(writer, "  %-8v %v\n", summary[0], summary[1])
+	}
+	fmt.Fprintln(writer, "\nRun partyinvites <command> -h for the flags of a command.")
+}
+
+// setupCommand loads the configuration for a command that uses the store.
+// Flags must come before other arguments.
+func setupCommand(flags *flag.FlagSet, args []string) error {
+	cfg, err := loadConfig(flags, args)
+	if err != nil {
+		return err
+	}
+	config = cfg
+	setupLogging(config.LogFormat, config.LogLevel)
+	return nil
+}
+
+// openStore locks and loads the store for a command. The caller must call
+// unlockStore when it is done.
+func openStore() error {
+	lockStore()
+	if err := storeLoadError(); err != nil {
+		unlockStore()
+		return fmt.Errorf("%v: %w", storePath(), err)
+	}
+	return nil
+}
+
+// withMail runs a change that may send mail, such as a waitlist promotion,
+// and waits for the mail to be sent before the command exits.
+func withMail(change func() error) error {
+	go mailWorker()
+	err := change()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if mailErr := stopMail(ctx); mailErr != nil && err == nil {
+		err = fmt.Errorf("queued mail was not sent: %w", mailErr)
+	}
+	return err
+}
+
+func outputFlag(flags *flag.FlagSet) *string {
+	return flags.String("format", "table", "output format, table or json")
+}
+
+// writeOutput prints value as indented JSON, or as a table with the given
+// rows, the first of which is the header.
+func writeOutput(format string, value interface{}, rows [][]string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	case "table":
+		table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, row := range rows {
+			fmt.Fprintln(table, strings.Join(row, "\t"))
+		}
+		return table.Flush()
+	}
+	return fmt.Errorf("unknown format %q, use table or json", format)
+}
+
+func formatResponded(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(eventDateLayout)
+}
+
+func listCommand(args []string) error {
+	flags := flag.NewFlagSet("partyinvites list", flag.ContinueOnError)
+	format := outputFlag(flags)
+	status := flags.String("status", "", "only show guests who are attending, declined, pending or waitlist")
+	search := flags.String("q", "", "only show guests whose name or email contains this")
+	within := flags.Int("within", 0, "only show guests who answered in the last this many days")
+	order := flags.String("sort", "name", "sort by name, time (most recent first) or oldest")
+	if err := setupCommand(flags, args); err != nil {
+		return err
+	}
+	if err := openStore(); err != nil {
+		return err
+	}
+	all := allGuests()
+	unlockStore()
+	guests := []guestEntry{}
+	for _, guest := range all {
+		if (*status == "" || guest.Status == *status) && (*search == "" || matchesSearch(guest, *search)) &&
+			respondedWithin(guest, *within) {
+			guests = append(guests, guest)
+		}
+	}
+	sortGuests(guests, *order)
+	rows := [][]string{{"NAME", "EMAIL", "PHONE", "HOUSEHOLD", "STATUS", "PLUS-ONES", "RESPONDED", "SOURCE"}}
+	for _, guest := range guests {
+		rows = append(rows, []string{guest.Name, guest.Email, guest.Phone, guest.Household,
+			guest.Status, strconv.Itoa(guest.PlusOnes), formatResponded(guest.Updated), guest.Source})
+	}
+	return writeOutput(*format, guests, rows)
+}
+
+func addCommand(args []string) error {
+	flags := flag.NewFlagSet("partyinvites add", flag.ContinueOnError)
+	rsvp := Rsvp{Source: sourceAdmin}
+	flags.StringVar(&rsvp.Name, "name", "", "guest's name")
+	flags.StringVar(&rsvp.Email, "email", "", "guest's email address, which identifies an earlier answer to replace")
+	flags.StringVar(&rsvp.Phone, "phone", "", "guest's phone number")
+	flags.BoolVar(&rsvp.WillAttend, "attend", true, "whether the guest is coming")
+	flags.IntVar(&rsvp.PlusOnes, "plus-ones", 0, "number of guests they are bringing")
+	if err := setupCommand(flags, args); err != nil {
+		return err
+	}
+	if problems := validateRsvp(&rsvp, english); len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return withMail(func() error {
+		if err := openStore(); err != nil {
+			return err
+		}
+		defer unlockStore()
+		before := captureStore()
+		previous, promotions := saveResponse(&rsvp)
+		if err := saveChange(before); err != nil {
+			return err
+		}
+		recordChange(adminSource(), "", previous, &rsvp)
+		announcePromotions(promotions)
+		action := "Added"
+		if previous != nil {
+			action = "Updated"
+		}
+		fmt.Printf("%v RSVP for %v <%v>: %v\n", action, rsvp.Name, rsvp.Email, rsvpStatus(&rsvp))
+		return nil
+	})
+}
+
+// removeCommand deletes every response and invitation with the given email
+// addresses, which frees their places for guests on the waitlist.
+func removeCommand(args []string) error {
+	flags := flag.NewFlagSet("partyinvites remove", flag.ContinueOnError)
+	if err := setupCommand(flags, args); err != nil {
+		return err
+	} else if flags.NArg() == 0 {
+		return errors.New("usage: partyinvites remove [flags] email...")
+	}
+	return withMail(func() error {
+		if err := openStore(); err != nil {
+			return err
+		}
+		defer unlockStore()
+		removed := map[string][2]int{}
+		removedResponses, keptResponses := []*Rsvp{}, []*Rsvp{}
+		for _, rsvp := range responses {
+			if email := matchingEmail(rsvp.Email, flags.Args()); email != "" {
+				counts := removed[email]
+				counts[0]++
+				removed[email] = counts
+				removedResponses = append(removedResponses, rsvp)
+			} else {
+				keptResponses = append(keptResponses, rsvp)
+			}
+		}
+		keptInvitations := []*Invitation{}
+		for _, inv := range invitations {
+			if email := matchingEmail(inv.Email, flags.Args()); email != "" {
+				counts := removed[email]
+				counts[1]++
+				removed[email] = counts
+			} else {
+				keptInvitations = append(keptInvitations, inv)
+			}
+		}
+		if len(removed) < flags.NArg() {
+			missing := []string{}
+			for _, email := range flags.Args() {
+				if _, ok := removed[email]; !ok {
+					missing = append(missing, email)
+				}
+			}
+			return fmt.Errorf("no guest with email %v", strings.Join(missing, ", "))
+		}
+		before := captureStore()
+		responses, invitations = keptResponses, keptInvitations
+		promotions := promoteWaitlist()
+		if err := saveChange(before); err != nil {
+			return err
+		}
+		for _, rsvp := range removedResponses {
+			recordChange(adminSource(), auditRemove, rsvp, nil)
+		}
+		announcePromotions(promotions)
+		for _, email := range flags.Args() {
+			fmt.Printf("Removed %v responses and %v invitations for %v\n", removed[email][0], removed[email][1], email)
+		}
+		return nil
+	})
+}
+
+func matchingEmail(email string, emails []string) string {
+	for _, candidate := range emails {
+		if strings.EqualFold(email, candidate) {
+			return candidate
+		}
+	}
+	return ""
+}
+
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("partyinvites export", flag.ContinueOnError)
+	format := flags.String("format", "csv", "output format, csv or json")
+	output := flags.String("o", "", "file to write instead of standard output")
+	if err := setupCommand(flags, args); err != nil {
+		return err
+	}
+	if *format != "csv" && *format != "json" {
+		return fmt.Errorf("unknown format %q, use csv or json", *format)
+	}
+	if err := openStore(); err != nil {
+		return err
+	}
+	guests := allGuests()
+	unlockStore()
+	sortGuests(guests, "name")
+	var writer io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		writer = file
+	}
+	if *format == "json" {
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(guests)
+	}
+	records := csv.NewWriter(writer)
+	records.Write([]string{"name", "email", "phone", "household", "status", "plus_ones",
+		"created", "updated", "source", "user_agent"})
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	for _, guest := range guests {
+		records.Write([]string{guest.Name, guest.Email, guest.Phone, guest.Household, guest.Status,
+			strconv.Itoa(guest.PlusOnes), formatTime(guest.Created), formatTime(guest.Updated), guest.Source, guest.UserAgent})
+	}
+	records.Flush()
+	return records.Error()
+}
+
+type statsData struct {
+	Event        string `json:"event"`
+	Date         string `json:"date,omitempty"`
+	Capacity     int    `json:"capacity"`
+	Invited      int    `json:"invited"`
+	Responded    int    `json:"responded"`
+	Pending      int    `json:"pending"`
+	ResponseRate string `json:"responseRate"`
+	Attending    int    `json:"attending"`
+	Declined     int    `json:"declined"`
+	Waitlisted   int    `json:"waitlisted"`
+	Headcount    int    `json:"headcount"`
+}
+
+func statsCommand(args []string) error {
+	flags := flag.NewFlagSet("partyinvites stats", flag.ContinueOnError)
+	format := outputFlag(flags)
+	if err := setupCommand(flags, args); err != nil {
+		return err
+	}
+	if err := openStore(); err != nil {
+		return err
+	}
+	dashboard := buildDashboard()
+	unlockStore()
+	stats := statsData{
+		Event: config.Event.Name, Date: config.Event.Date, Capacity: config.Event.Capacity,
+		Invited: dashboard.Invited, Responded: dashboard.Responded, Pending: dashboard.Pending,
+		ResponseRate: dashboard.ResponseRate, Attending: dashboard.Attending, Declined: dashboard.Declined,
+		Waitlisted: dashboard.Waitlisted, Headcount: dashboard.Headcount,
+	}
+	capacity := "unlimited"
+	if stats.Capacity > 0 {
+		capacity = strconv.Itoa(stats.Capacity)
+	}
+	rows := [][]string{
+		{"Event", stats.Event}, {"Date", stats.Date}, {"Capacity", capacity},
+		{"Invited", strconv.Itoa(stats.Invited)}, {"Responded", strconv.Itoa(stats.Responded)},
+		{"Pending", strconv.Itoa(stats.Pending)}, {"Response rate", stats.ResponseRate},
+		{"Attending", strconv.Itoa(stats.Attending)}, {"Declined", strconv.Itoa(stats.Declined)},
+		{"Waitlisted", strconv.Itoa(stats.Waitlisted)}, {"Headcount", strconv.Itoa(stats.Headcount)},
+	}
+	return writeOutput(*format, stats, rows)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const eventDateLayout = "2006-01-02 15:04"
+
+type EventConfig struct {
+	Name        string `json:"name"`
+	Date        string `json:"date"`
+	Location    string `json:"location"`
+	Description string `json:"description"`
+	// Capacity limits how many guests, including plus-ones, can attend.
+	// Guests who answer yes once the party is full are put on the waitlist.
+	// Zero means there is no limit.
+	Capacity int `json:"capacity"`
+	// RetentionDays is how many days after the event the guests' personal
+	// data is anonymized. Zero keeps it.
+	RetentionDays int `json:"retentionDays"`
+}
+
+// When returns the parsed event date, or the zero time if none is set.
+func (event EventConfig) When() time.Time {
+	when, _ := time.ParseInLocation(eventDateLayout, event.Date, time.Local)
+	return when
+}
+
+type Config struct {
+	Addr        string         `json:"addr"`
+	DataDir     string         `json:"dataDir"`
+	TemplateDir string         `json:"templateDir"`
+	StaticDir   string         `json:"staticDir"`
+	BaseURL     string         `json:"baseURL"`
+	Dev         bool           `json:"dev"`
+	LogFormat   string         `json:"logFormat"`
+	LogLevel    string         `json:"logLevel"`
+	TLS         tlsConfig      `json:"tls"`
+	Security    securityConfig `json:"security"`
+	Mail        mailConfig     `json:"mail"`
+	Host        hostConfig     `json:"host"`
+	Event       EventConfig    `json:"event"`
+}
+
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Addr:      ":5000",
+		DataDir:   "./data",
+		BaseURL:   "http://localhost:5000",
+		LogFormat: "text",
+		LogLevel:  "info",
+		TLS:       tlsConfig{HSTSMaxAge: 31536000},
+		Security:  defaultSecurity(),
+		Mail:      mailConfig{Port: 587, From: "party@localhost"},
+		Host:      hostConfig{User: "host"},
+		Event:     EventConfig{Name: "Party Time"},
+	}
+}
+
+// A setting connects a configuration field to its command line flag and
+// environment variable.
+type setting struct {
+	flag, env, usage string
+	target           interface{}
+}
+
+func (cfg *Config) settings() []setting {
+	return []setting{
+		{"addr", "PARTY_ADDR", "address to listen on", &cfg.Addr},
+		{"data-dir", "PARTY_DATA_DIR", "directory where RSVPs are stored", &cfg.DataDir},
+		{"template-dir", "PARTY_TEMPLATE_DIR", "directory with templates that override the built-in ones", &cfg.TemplateDir},
+		{"static-dir", "PARTY_STATIC_DIR", "directory with files that override the built-in /assets/", &cfg.StaticDir},
+		{"base-url", "PARTY_BASE_URL", "public URL used in links sent by email", &cfg.BaseURL},
+		{"dev", "PARTY_DEV", "reload templates from -template-dir when they change", &cfg.Dev},
+		{"log-format", "PARTY_LOG_FORMAT", "log output format, text or json", &cfg.LogFormat},
+		{"log-level", "PARTY_LOG_LEVEL", "lowest level to log: debug, info, warn or error", &cfg.LogLevel},
+		{"tls-cert", "PARTY_TLS_CERT", "certificate file for HTTPS", &cfg.TLS.Cert},
+		{"tls-key", "PARTY_TLS_KEY", "private key file for HTTPS", &cfg.TLS.Key},
+		{"tls-self-signed", "PARTY_TLS_SELF_SIGNED", "serve HTTPS with a self-signed certificate generated in the data directory", &cfg.TLS.SelfSigned},
+		{"redirect-addr", "PARTY_REDIRECT_ADDR", "address for a plain HTTP listener that redirects to HTTPS", &cfg.TLS.RedirectAddr},
+		{"hsts-max-age", "PARTY_HSTS_MAX_AGE", "seconds browsers should only use HTTPS, 0 to disable", &cfg.TLS.HSTSMaxAge},
+		{"csp", "PARTY_CSP", "Content Security Policy; {nonce} is replaced for each request, empty to disable", &cfg.Security.CSP},
+		{"csp-report-only", "PARTY_CSP_REPORT_ONLY", "report Content Security Policy violations without enforcing the policy", &cfg.Security.CSPReportOnly},
+		{"frame-ancestors", "PARTY_FRAME_ANCESTORS", "sites allowed to show the pages in a frame; the theme preview needs 'self'", &cfg.Security.FrameAncestors},
+		{"referrer-policy", "PARTY_REFERRER_POLICY", "Referrer-Policy header, empty to omit", &cfg.Security.ReferrerPolicy},
+		{"permissions-policy", "PARTY_PERMISSIONS_POLICY", "Permissions-Policy header, empty to omit", &cfg.Security.PermissionsPolicy},
+		{"smtp-host", "PARTY_SMTP_HOST", "SMTP server; mail is printed to the console if empty", &cfg.Mail.Host},
+		{"smtp-port", "PARTY_SMTP_PORT", "SMTP server port", &cfg.Mail.Port},
+		{"smtp-username", "PARTY_SMTP_USERNAME", "SMTP user name", &cfg.Mail.Username},
+		{"smtp-password", "PARTY_SMTP_PASSWORD", "SMTP password", &cfg.Mail.Password},
+		{"mail-from", "PARTY_MAIL_FROM", "sender address for emails", &cfg.Mail.From},
+		{"host-user", "PARTY_HOST_USER", "user name for the host pages", &cfg.Host.User},
+		{"host-password", "PARTY_HOST_PASSWORD", "password for the host pages, which are turned off without one", &cfg.Host.Password},
+		{"event-name", "PARTY_EVENT_NAME", "name of the event", &cfg.Event.Name},
+		{"event-date", "PARTY_EVENT_DATE", "date of the event as YYYY-MM-DD HH:MM", &cfg.Event.Date},
+		{"event-location", "PARTY_EVENT_LOCATION", "where the event takes place", &cfg.Event.Location},
+		{"event-description", "PARTY_EVENT_DESCRIPTION", "description shown on the welcome page", &cfg.Event.Description},
+		{"event-capacity", "PARTY_EVENT_CAPACITY", "maximum number of guests, 0 for no limit", &cfg.Event.Capacity},
+		{"retention-days", "PARTY_RETENTION_DAYS", "days after the event when guests' personal data is anonymized, 0 to keep it", &cfg.Event.RetentionDays},
+	}
+}
+
+func setValue(target interface{}, value string) error {
+	switch target := target.(type) {
+	case *string:
+		*target = value
+	case *int:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		*target = number
+	case *bool:
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		*target = enabled
+	}
+	return nil
+}
+
+// flagValue records the raw text of a flag so it can be applied after the
+// configuration file and environment variables.
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+func (f *flagValue) String() string     { return f.value }
+func (f *flagValue) Set(v string) error { f.value = v; return nil }
+func (f *flagValue) IsBoolFlag() bool   { return f.isBool }
+
+// loadConfig builds the configuration from, in increasing order of
+// precedence, the defaults, the JSON file named by -config or PARTY_CONFIG,
+// environment variables and command line flags. Commands can add flags of
+// their own to flags before calling it and read their arguments afterwards.
+func loadConfig(flags *flag.FlagSet, args []string) (Config, error) {
+	cfg := defaultConfig()
+	configFile := flags.String("config", os.Getenv("PARTY_CONFIG"), "optional JSON configuration file")
+	flagValues := map[string]*flagValue{}
+	for _, s := range cfg.settings() {
+		_, isBool := s.target.(*bool)
+		flagValues[s.flag] = &flagValue{isBool: isBool}
+		flags.Var(flagValues[s.flag], s.flag, fmt.Sprintf("%v (env %v)", s.usage, s.env))
+	}
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return cfg, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&cfg); err != nil {
+			return cfg, fmt.Errorf("%v: %w", *configFile, err)
+		}
+	}
+	for _, s := range cfg.settings() {
+		if value, ok := os.LookupEnv(s.env); ok {
+			if err := setValue(s.target, value); err != nil {
+				return cfg, fmt.Errorf("%v: %w", s.env, err)
+			}
+		}
+	}
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		for _, s := range cfg.settings() {
+			if s.flag == f.Name && err == nil {
+				if setErr := setValue(s.target, flagValues[s.flag].value); setErr != nil {
+					err = fmt.Errorf("-%v: %w", s.flag, setErr)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return cfg, err
+	}
+	cfg.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	return cfg, cfg.validate()
+}
+
+// validate checks the configuration at startup and creates the data
+// directory if it does not exist yet. All problems are reported together.
+func (cfg *Config) validate() error {
+	problems := []string{}
+	if _, _, err := net.SplitHostPort(cfg.Addr); err != nil {
+		problems = append(problems, fmt.Sprintf("addr %q is not a valid listen address", cfg.Addr))
+	}
+	if err := os.MkdirAll(cfg.DataDir, 0o755); err != nil {
+		problems = append(problems, fmt.Sprintf("data directory cannot be created: %v", err))
+	}
+	for _, dir := range [2]string{cfg.TemplateDir, cfg.StaticDir} {
+		if info, err := os.Stat(dir); dir != "" && (err != nil || !info.IsDir()) {
+			problems = append(problems, fmt.Sprintf("override directory %q is not a directory", dir))
+		}
+	}
+	if cfg.Dev && cfg.TemplateDir == "" {
+		problems = append(problems, "dev mode needs a template directory to watch")
+	}
+	if u, err := url.Parse(cfg.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("base URL %q must be an absolute http or https URL", cfg.BaseURL))
+	}
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		problems = append(problems, fmt.Sprintf("log format %q must be text or json", cfg.LogFormat))
+	}
+	switch cfg.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, fmt.Sprintf("log level %q must be debug, info, warn or error", cfg.LogLevel))
+	}
+	if (cfg.TLS.Cert == "") != (cfg.TLS.Key == "") {
+		problems = append(problems, "TLS needs both a certificate and a key file")
+	} else if cfg.TLS.Cert != "" && cfg.TLS.SelfSigned {
+		problems = append(problems, "TLS certificate files and a self-signed certificate cannot be used together")
+	} else if cfg.TLS.Cert != "" {
+		if _, err := tls.LoadX509KeyPair(cfg.TLS.Cert, cfg.TLS.Key); err != nil {
+			problems = append(problems, fmt.Sprintf("TLS certificate cannot be loaded: %v", err))
+		}
+	}
+	if u, err := url.Parse(cfg.BaseURL); err == nil && cfg.TLS.Enabled() && u.Scheme != "https" {
+		problems = append(problems, fmt.Sprintf("base URL %q must be an https URL when TLS is enabled", cfg.BaseURL))
+	}
+	if cfg.TLS.RedirectAddr != "" {
+		if !cfg.TLS.Enabled() {
+			problems = append(problems, "the HTTPS redirect listener needs TLS to be configured")
+		} else if _, _, err := net.SplitHostPort(cfg.TLS.RedirectAddr); err != nil {
+			problems = append(problems, fmt.Sprintf("redirect address %q is not a valid listen address", cfg.TLS.RedirectAddr))
+		}
+	}
+	if cfg.TLS.HSTSMaxAge < 0 {
+		problems = append(problems, "HSTS max age must not be negative")
+	}
+	if cfg.Security.CSP != "" && !strings.Contains(cfg.Security.CSP, "{nonce}") {
+		problems = append(problems, "the Content Security Policy must allow the pages' inline scripts and styles with 'nonce-{nonce}'")
+	}
+	if cfg.Mail.Host != "" && (cfg.Mail.Port <= 0 || cfg.Mail.Port > 65535) {
+		problems = append(problems, fmt.Sprintf("SMTP port %v is out of range", cfg.Mail.Port))
+	}
+	if _, err := mail.ParseAddress(cfg.Mail.From); err != nil {
+		problems = append(problems, fmt.Sprintf("mail sender %q is not a valid address", cfg.Mail.From))
+	}
+	if cfg.Host.Password != "" && cfg.Host.User == "" {
+		problems = append(problems, "the host pages need a user name")
+	}
+	if cfg.Event.Name == "" {
+		problems = append(problems, "event name must not be empty")
+	}
+	if cfg.Event.Date != "" && cfg.Event.When().IsZero() {
+		problems = append(problems, fmt.Sprintf("event date %q must use the format YYYY-MM-DD HH:MM", cfg.Event.Date))
+	}
+	if cfg.Event.Capacity < 0 {
+		problems = append(problems, "event capacity must not be negative")
+	}
+	if cfg.Event.RetentionDays < 0 {
+		problems = append(problems, "retention days must not be negative")
+	} else if cfg.Event.RetentionDays > 0 && cfg.Event.Date == "" {
+		problems = append(problems, "a retention period needs an event date to count from")
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type chartBar struct {
+	Label                           string
+	ShowLabel                       bool
+	X, Width, AttendingY, DeclinedY float64
+	AttendingHeight, DeclinedHeight float64
+	Attending, Declined             int
+}
+
+// responseChart holds the geometry for the responses-over-time chart, which
+// dashboard.html draws as inline SVG so it needs no scripts or CDN.
+type responseChart struct {
+	Width, Height, Baseline float64
+	Max                     int
+	Bars                    []chartBar
+}
+
+type dashboardData struct {
+	Invited, Responded, Pending                int
+	Attending, Declined, Waitlisted, Headcount int
+	ResponseRate                               string
+	Chart                                      responseChart
+}
+
+// hasResponded checks whether an invitee has answered, either themselves or
+// as a member of their household.
+func hasResponded(inv *Invitation) bool {
+	for _, rsvp := range responses {
+		if rsvp.Household != "" {
+			if strings.EqualFold(rsvp.Household, inv.Group) && rsvp.Name == inv.Name {
+				return true
+			}
+		} else if strings.EqualFold(rsvp.Email, inv.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+func buildDashboard() dashboardData {
+	data := dashboardData{Invited: len(invitations), Headcount: headcount(nil)}
+	for _, rsvp := range responses {
+		if rsvp.Waitlisted {
+			data.Waitlisted++
+		} else if rsvp.WillAttend {
+			data.Attending++
+		} else {
+			data.Declined++
+		}
+	}
+	for _, inv := range invitations {
+		if hasResponded(inv) {
+			data.Responded++
+		} else {
+			data.Pending++
+		}
+	}
+	if data.Invited > 0 {
+		data.ResponseRate = fmt.Sprintf("%.0f%%", float64(data.Responded)*100/float64(data.Invited))
+	} else {
+		data.ResponseRate = "n/a"
+	}
+	data.Chart = buildResponseChart(responses)
+	return data
+}
+
+// buildResponseChart stacks attending and declined answers for each day
+// between the first and last response, including days with no answers.
+func buildResponseChart(rsvps []*Rsvp) responseChart {
+	chart := responseChart{Width: 600, Height: 220, Baseline: 190}
+	if len(rsvps) == 0 {
+		return chart
+	}
+	day := func(t time.Time) time.Time {
+		year, month, date := t.Date()
+		return time.Date(year, month, date, 0, 0, 0, 0, t.Location())
+	}
+	first, last := day(rsvps[0].Updated), day(rsvps[0].Updated)
+	for _, rsvp := range rsvps {
+		if d := day(rsvp.Updated); d.Before(first) {
+			first = d
+		} else if d.After(last) {
+			last = d
+		}
+	}
+	days := int(last.Sub(first).Hours()/24+0.5) + 1
+	if days > 60 {
+		first, days = last.AddDate(0, 0, -59), 60
+	}
+	counts := make([]chartBar, days)
+	for _, rsvp := range rsvps {
+		index := int(day(rsvp.Updated).Sub(first).Hours()/24 + 0.5)
+		if index < 0 {
+			continue
+		}
+		if rsvp.WillAttend {
+			counts[index].Attending++
+		} else {
+			counts[index].Declined++
+		}
+	}
+	for _, bar := range counts {
+		if total := bar.Attending + bar.Declined; total > chart.Max {
+			chart.Max = total
+		}
+	}
+	labelEvery := (days + 9) / 10
+	slot := (chart.Width - 40) / float64(days)
+	if slot > 60 {
+		slot = 60
+	}
+	scale := (chart.Baseline - 20) / float64(chart.Max)
+	for i, bar := range counts {
+		bar.Label = first.AddDate(0, 0, i).Format("Jan 2")
+		bar.ShowLabel = i%labelEvery == 0
+		bar.X = 30 + float64(i)*slot + slot*0.1
+		bar.Width = slot * 0.8
+		bar.AttendingHeight = float64(bar.Attending) * scale
+		bar.DeclinedHeight = float64(bar.Declined) * scale
+		bar.AttendingY = chart.Baseline - bar.AttendingHeight
+		bar.DeclinedY = bar.AttendingY - bar.DeclinedHeight
+		chart.Bars = append(chart.Bars, bar)
+	}
+	return chart
+}
+
+func dashboardHandler(writer http.ResponseWriter, request *http.Request) {
+	lockStore()
+	defer unlockStore()
+	renderTemplate(writer, request, http.StatusOK, "dashboard", buildDashboard())
+}
@@ -0,0 +1,28 @@
+#!/bin/sh
+# Downloads the Bootstrap release used by layout.html into static/vendor so it
+# is embedded in the binary and served from /assets/ instead of a CDN. The
+# files are checked against the Subresource Integrity hashes published for
+# the release.
+set -eu
+
+VERSION=5.0.2
+BASE=https://cdn.jsdelivr.net/npm/bootstrap@$VERSION/dist
+DEST=$(dirname "$0")/static/vendor/bootstrap
+
+fetch() {
+    file=$1
+    expected=$2
+    curl -fsSL "$BASE/$file" -o "$DEST/$(basename "$file").tmp"
+    actual=$(openssl dgst -sha384 -binary "$DEST/$(basename "$file").tmp" | openssl base64 -A)
+    if [ "$actual" != "$expected" ]; then
+        rm -f "$DEST/$(basename "$file").tmp"
+        echo "Integrity check failed for $file" >&2
+        exit 1
+    fi
+    mv "$DEST/$(basename "$file").tmp" "$DEST/$(basename "$file")"
+    echo "Fetched $file"
+}
+
+mkdir -p "$DEST"
+fetch css/bootstrap.min.css EVSTQN3/azprG1Anm3QDgpJLIm9Nao0Yz1ztcQTwFspd3yD65VohhpuuCOmLASjC
+fetch js/bootstrap.bundle.min.js MrcW6ZMFYlzcLA8Nl+NtUVF0sA7MsXsP1UyJoMp4YLEuNSfAP+JcXn/tWtIaxVXM
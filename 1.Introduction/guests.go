@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	statusAttending = "attending"
+	statusDeclined  = "declined"
+	statusPending   = "pending"
+	statusWaitlist  = "waitlist"
+)
+
+type guestEntry struct {
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Phone     string    `json:"phone"`
+	Household string    `json:"household,omitempty"`
+	Status    string    `json:"status"`
+	PlusOnes  int       `json:"plusOnes"`
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+	Source    string    `json:"source,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+}
+
+// RespondedAgo says how long ago the guest last answered, in whole days.
+func (guest guestEntry) RespondedAgo() string {
+	if guest.Updated.IsZero() {
+		return ""
+	}
+	switch days := int(time.Since(guest.Updated).Hours() / 24); days {
+	case 0:
+		return "today"
+	case 1:
+		return "yesterday"
+	default:
+		return fmt.Sprintf("%v days ago", days)
+	}
+}
+
+type guestTab struct {
+	Label, URL string
+	Count      int
+	Active     bool
+}
+
+type guestsData struct {
+	Guests         []guestEntry
+	Tabs           []guestTab
+	Status, Search string
+	Sort           string
+	Within         int
+}
+
+func rsvpStatus(rsvp *Rsvp) string {
+	if rsvp.Waitlisted {
+		return statusWaitlist
+	} else if rsvp.WillAttend {
+		return statusAttending
+	}
+	return statusDeclined
+}
+
+// allGuests combines responses with the invitations that have not been
+// answered yet, so declined and pending guests are visible to the host.
+func allGuests() []guestEntry {
+	guests := []guestEntry{}
+	for _, rsvp := range responses {
+		guests = append(guests, guestEntry{
+			Name: rsvp.Name, Email: rsvp.Email, Phone: rsvp.Phone,
+			Household: rsvp.Household, Status: rsvpStatus(rsvp),
+			PlusOnes: rsvp.PlusOnes, Created: rsvp.Created, Updated: rsvp.Updated,
+			Source: rsvp.Source, UserAgent: rsvp.UserAgent,
+		})
+	}
+	for _, inv := range invitations {
+		if !hasResponded(inv) {
+			guests = append(guests, guestEntry{
+				Name: inv.Name, Email: inv.Email, Phone: inv.Phone,
+				Household: inv.Group, Status: statusPending,
+			})
+		}
+	}
+	return guests
+}
+
+func matchesSearch(guest guestEntry, search string) bool {
+	search = strings.ToLower(search)
+	return strings.Contains(strings.ToLower(guest.Name), search) ||
+		strings.Contains(strings.ToLower(guest.Email), search)
+}
+
+// respondedWithin reports whether a guest answered in the last number of
+// days, where zero days matches every guest.
+func respondedWithin(guest guestEntry, days int) bool {
+	return days == 0 || (!guest.Updated.IsZero() && time.Since(guest.Updated) <= time.Duration(days)*24*time.Hour)
+}
+
+// sortGuests orders guests by name, or by when they last answered with the
+// most recent ("time") or the oldest ("oldest") first. Pending guests have no
+// response time and are sorted last either way.
+func sortGuests(guests []guestEntry, order string) {
+	sort.SliceStable(guests, func(i, j int) bool {
+		a, b := guests[i].Updated, guests[j].Updated
+		switch {
+		case order == "time":
+			return a.After(b)
+		case order == "oldest":
+			return !a.IsZero() && (b.IsZero() || a.Before(b))
+		}
+		return strings.ToLower(guests[i].Name) < strings.ToLower(guests[j].Name)
+	})
+}
+
+func guestsHandler(writer http.ResponseWriter, request *http.Request) {
+	lockStore()
+	defer unlockStore()
+	data := guestsData{
+		Status: request.FormValue("status"),
+		Search: strings.TrimSpace(request.FormValue("q")),
+		Sort:   request.FormValue("sort"),
+	}
+	if data.Sort != "time" && data.Sort != "oldest" {
+		data.Sort = "name"
+	}
+	if within, err := strconv.Atoi(request.FormValue("within")); err == nil && within > 0 {
+		data.Within = within
+	}
+	counts := map[string]int{}
+	for _, guest := range allGuests() {
+		if (data.Search != "" && !matchesSearch(guest, data.Search)) || !respondedWithin(guest, data.Within) {
+			continue
+		}
+		counts[guest.Status]++
+		counts[""]++
+		if data.Status == "" || guest.Status == data.Status {
+			data.Guests = append(data.Guests, guest)
+		}
+	}
+	sortGuests(data.Guests, data.Sort)
+	tabs := [5][2]string{
+		{"", "All"}, {statusAttending, "Attending"}, {statusDeclined, "Declined"},
+		{statusPending, "Pending"}, {statusWaitlist, "Waitlist"},
+	}
+	for _, tab := range tabs {
+		query := url.Values{"sort": {data.Sort}}
+		if tab[0] != "" {
+			query.Set("status", tab[0])
+		}
+		if data.Search != "" {
+			query.Set("q", data.Search)
+		}
+		if data.Within > 0 {
+			query.Set("within", strconv.Itoa(data.Within))
+		}
+		data.Tabs = append(data.Tabs, guestTab{
+			Label: tab[1], URL: "/host/guests?" + query.Encode(),
+			Count: counts[tab[0]], Active: tab[0] == data.Status,
+		})
+	}
+	renderTemplate(writer, request, http.StatusOK, "guests", data)
+}
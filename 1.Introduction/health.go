@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+)
+
+// workers records whether each background goroutine is still running, so
+// readyzHandler can tell when one of them has stopped.
+var workers = map[string]bool{}
+var workersLock sync.Mutex
+
+func startWorker(name string, work func()) {
+	workersLock.Lock()
+	workers[name] = true
+	workersLock.Unlock()
+	go func() {
+		defer func() {
+			workersLock.Lock()
+			workers[name] = false
+			workersLock.Unlock()
+		}()
+		work()
+	}()
+}
+
+type healthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string        `json:"status"`
+	Checks []healthCheck `json:"checks,omitempty"`
+}
+
+func newCheck(name string, err error) healthCheck {
+	if err != nil {
+		return healthCheck{Name: name, Error: err.Error()}
+	}
+	return healthCheck{Name: name, OK: true}
+}
+
+// checkStore makes sure the RSVP store was loaded and that the data
+// directory can still be read and written. It does not take storeLock, which
+// lockStore holds while it waits for the file lock that the command line
+// tools may hold.
+func checkStore() error {
+	if loadErr := storeLoadError(); loadErr != nil {
+		return fmt.Errorf("store could not be loaded: %w", loadErr)
+	}
+	if file, err := os.Open(storePath()); err == nil {
+		file.Close()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	file, err := os.CreateTemp(config.DataDir, "ready-*.tmp")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func readinessChecks() []healthCheck {
+	templatesLock.RLock()
+	templatesErr := templateError
+	templatesLock.RUnlock()
+	checks := []healthCheck{newCheck("templates", templatesErr), newCheck("store", checkStore())}
+	workersLock.Lock()
+	names := make([]string, 0, len(workers))
+	for name := range workers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var err error
+		if !workers[name] {
+			err = errors.New("not running")
+		}
+		checks = append(checks, newCheck("worker:"+name, err))
+	}
+	workersLock.Unlock()
+	return checks
+}
+
+func writeHealth(writer http.ResponseWriter, report healthReport) {
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(report)
+}
+
+// healthzHandler answers as long as the process can serve requests at all.
+func healthzHandler(writer http.ResponseWriter, request *http.Request) {
+	writeHealth(writer, healthReport{Status: "ok"})
+}
+
+// readyzHandler reports whether the server can do its job: the templates
+// parsed, the store is usable and the background workers are running.
+func readyzHandler(writer http.ResponseWriter, request *http.Request) {
+	report := healthReport{Status: "ok", Checks: readinessChecks()}
+	for _, check := range report.Checks {
+		if !check.OK {
+			report.Status = "unavailable"
+		}
+	}
+	writeHealth(writer, report)
+}
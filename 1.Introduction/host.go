@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+)
+
+// The host pages under /host/ show every guest's details and change the
+// event, so they need the host's user name and password, which the browser
+// asks for with HTTP basic authentication. Browsers send those credentials
+// with requests that other sites trigger too, so forms that change something
+// also carry a CSRF token that only pages from this site can know.
+
+// hostConfig holds the host's credentials. Without a password the host pages
+// are turned off.
+type hostConfig struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// csrfKey signs CSRF tokens. It is new each time the server starts, so forms
+// opened before a restart have to be loaded again.
+var csrfKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// csrfToken returns the token host forms send back, which is tied to the
+// host's user name.
+func csrfToken() string {
+	mac := hmac.New(sha256.New, csrfKey)
+	mac.Write([]byte("csrf\n" + config.Host.User))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func checkCSRFToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(csrfToken())) == 1
+}
+
+// hostOnly lets a request through to a host page only with the host's
+// credentials and, for anything but GET and HEAD, a valid CSRF token.
+func hostOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		host := config.Host
+		if host.Password == "" {
+			showError(writer, request, http.StatusForbidden, "error.host-disabled")
+			return
+		}
+		user, password, ok := request.BasicAuth()
+		userMatches := subtle.ConstantTimeCompare([]byte(user), []byte(host.User)) == 1
+		passwordMatches := subtle.ConstantTimeCompare([]byte(password), []byte(host.Password)) == 1
+		if !ok || !userMatches || !passwordMatches {
+			if ok {
+				loggerFor(request).Warn("host login failed", "user", user)
+			}
+			writer.Header().Set("WWW-Authenticate", `Basic realm="Party host", charset="UTF-8"`)
+			showError(writer, request, http.StatusUnauthorized, "error.host-login")
+			return
+		}
+		if request.Method != http.MethodGet && request.Method != http.MethodHead &&
+			!checkCSRFToken(request.FormValue("csrf")) {
+			loggerFor(request).Warn("host form sent without a valid CSRF token")
+			showError(writer, request, http.StatusForbidden, "error.csrf")
+			return
+		}
+		writer.Header().Set("Cache-Control", "no-store")
+		next(writer, request)
+	}
+}
+
+// warnHostDisabled tells the operator at startup why the host pages refuse
+// every request.
+func warnHostDisabled() {
+	if config.Host.Password == "" {
+		slog.Warn("no host password is configured, the host pages are turned off")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A Household is a party group that receives one invitation but has several
+// members, each of whom can attend or not.
+type Household struct {
+	Name    string
+	Members []*Invitation
+}
+
+func findHousehold(name string) *Household {
+	if name == "" {
+		return nil
+	}
+	household := &Household{}
+	for _, inv := range invitations {
+		if strings.EqualFold(inv.Group, name) {
+			household.Name = inv.Group
+			household.Members = append(household.Members, inv)
+		}
+	}
+	if len(household.Members) == 0 {
+		return nil
+	}
+	return household
+}
+
+// findMember returns the invitation of a household member.
+func findMember(household, name string) *Invitation {
+	for _, inv := range invitations {
+		if strings.EqualFold(inv.Group, household) && inv.Name == name {
+			return inv
+		}
+	}
+	return nil
+}
+
+type householdMember struct {
+	*Invitation
+	WillAttend bool
+}
+
+type householdData struct {
+	Household string
+	*Rsvp
+	Members []householdMember
+	Errors  []string
+}
+
+// memberAttendance returns the current answer for each member of the
+// household so the form shows previous responses when it is revisited.
+func memberAttendance(household *Household) []householdMember {
+	members := make([]householdMember, len(household.Members))
+	for i, inv := range household.Members {
+		members[i] = householdMember{Invitation: inv}
+		for _, rsvp := range responses {
+			if rsvp.Household == household.Name && rsvp.Name == inv.Name {
+				members[i].WillAttend = rsvp.WillAttend
+			}
+		}
+	}
+	return members
+}
+
+func householdHandler(writer http.ResponseWriter, request *http.Request) {
+	lockStore()
+	defer unlockStore()
+	household := findHousehold(request.FormValue("name"))
+	if household == nil {
+		showError(writer, request, http.StatusNotFound, "error.household-not-found")
+		return
+	}
+	if request.Method == http.MethodGet {
+		renderTemplate(writer, request, http.StatusOK, "household", householdData{
+			Household: household.Name, Rsvp: &Rsvp{},
+			Members: memberAttendance(household), Errors: []string{},
+		})
+	} else if request.Method == http.MethodPost {
+		request.ParseForm()
+		respondent := Rsvp{
+			Name:  request.Form.Get("respondent"),
+			Email: request.Form.Get("email"),
+			Phone: request.Form.Get("phone"),
+		}
+		members := memberAttendance(household)
+		for i := range members {
+			members[i].WillAttend = request.Form.Get("willattend-"+strconv.Itoa(i)) == "true"
+		}
+		errors := validateRsvp(&respondent, localizerFor(request))
+		if len(errors) > 0 {
+			renderTemplate(writer, request, http.StatusUnprocessableEntity, "household", householdData{
+				Household: household.Name, Rsvp: &respondent,
+				Members: members, Errors: errors,
+			})
+			return
+		}
+		before := captureStore()
+		kept := responses[:0]
+		previous := map[string]*Rsvp{}
+		for _, rsvp := range responses {
+			if rsvp.Household != household.Name {
+				kept = append(kept, rsvp)
+			} else {
+				previous[rsvp.Name] = rsvp
+			}
+		}
+		responses = kept
+		anyAttending, anyWaitlisted := false, false
+		for _, member := range members {
+			rsvp := &Rsvp{
+				Name: member.Name, Email: member.Email, Phone: member.Phone,
+				Household: household.Name, WillAttend: member.WillAttend,
+			}
+			rsvp.fromRequest(request)
+			if rsvp.Email == "" {
+				rsvp.Email = respondent.Email
+			}
+			if rsvp.Phone == "" {
+				rsvp.Phone = respondent.Phone
+			}
+			admit(rsvp, previous[rsvp.Name])
+			responses = append(responses, rsvp)
+			anyAttending = anyAttending || member.WillAttend
+			anyWaitlisted = anyWaitlisted || rsvp.Waitlisted
+		}
+		promotions := promoteWaitlist()
+		if err := saveChange(before); err != nil {
+			loggerFor(request).Error("failed to save household RSVP", "household", household.Name, "error", err)
+			showError(writer, request, http.StatusInternalServerError, "error.save-rsvp")
+			return
+		}
+		for _, rsvp := range responses[len(responses)-len(members):] {
+			recordChange(guestSource(request, respondent.Email), "", previous[rsvp.Name], rsvp)
+		}
+		announcePromotions(promotions)
+		loggerFor(request).Info("household RSVP saved", "household", household.Name, "email", respondent.Email,
+			"members", len(members), "attending", anyAttending, "waitlisted", anyWaitlisted)
+		publishGroup(responses[len(responses)-1])
+		if anyWaitlisted {
+			renderTemplate(writer, request, http.StatusOK, "waitlist", respondent.Name)
+		} else if anyAttending {
+			renderTemplate(writer, request, http.StatusOK, "thanks", respondent.Name)
+		} else {
+			renderTemplate(writer, request, http.StatusOK, "sorry", respondent.Name)
+		}
+	}
+}
+
+type listGroup struct {
+	Key, Household string
+	Attending      int
+	Guests         []*Rsvp
+}
+
+// groupKey identifies the list group a response belongs to, which is its
+// household or, for guests who answered for themselves, their email address.
+// The key is hashed because the list page sees it even for guests who do not
+// attend.
+func groupKey(rsvp *Rsvp) string {
+	key := "guest:" + strings.ToLower(rsvp.Email)
+	if rsvp.Household != "" {
+		key = "household:" + strings.ToLower(rsvp.Household)
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// groupByHousehold keeps responses in the order they were received, gathering
+// the members of each household together. Guests who answered for themselves
+// are each placed in their own group with an empty Household.
+func groupByHousehold(rsvps []*Rsvp) []*listGroup {
+	groups := []*listGroup{}
+	byKey := map[string]*listGroup{}
+	for _, rsvp := range rsvps {
+		key := groupKey(rsvp)
+		group := byKey[key]
+		if group == nil {
+			group = &listGroup{Key: key, Household: rsvp.Household}
+			groups = append(groups, group)
+			byKey[key] = group
+		}
+		group.Guests = append(group.Guests, rsvp)
+		if rsvp.WillAttend && !rsvp.Waitlisted {
+			group.Attending++
+		}
+	}
+	return groups
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message catalogs live in locales/<language>.json. A message is either a
+// string or, when it depends on a count, an object with "one" and "other"
+// forms. Messages use fmt verbs for their arguments.
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+const defaultLanguage = "en"
+
+type message struct {
+	Text   string
+	Plural map[string]string
+}
+
+func (m *message) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &m.Text); err == nil {
+		return nil
+	}
+	return json.Unmarshal(data, &m.Plural)
+}
+
+var catalogs = loadCatalogs()
+
+func loadCatalogs() map[string]map[string]message {
+	loaded := map[string]map[string]message{}
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	for _, file := range files {
+		data, err := localeFiles.ReadFile("locales/" + file.Name())
+		if err != nil {
+			panic(err)
+		}
+		messages := map[string]message{}
+		if err := json.Unmarshal(data, &messages); err != nil {
+			panic(fmt.Sprintf("locales/%v: %v", file.Name(), err))
+		}
+		loaded[strings.TrimSuffix(file.Name(), path.Ext(file.Name()))] = messages
+	}
+	return loaded
+}
+
+// pluralRules choose between the "one" and "other" forms of a message.
+var pluralRules = map[string]func(int) string{
+	"en": func(n int) string { return pluralOneIf(n == 1) },
+	"de": func(n int) string { return pluralOneIf(n == 1) },
+	"fr": func(n int) string { return pluralOneIf(n == 0 || n == 1) },
+}
+
+func pluralOneIf(one bool) string {
+	if one {
+		return "one"
+	}
+	return "other"
+}
+
+type localizer struct {
+	Lang string
+}
+
+var english = localizer{Lang: defaultLanguage}
+
+// lookup falls back to English and then to the key itself, so a missing
+// translation shows up on the page rather than breaking it.
+func (l localizer) lookup(key string) message {
+	if msg, ok := catalogs[l.Lang][key]; ok {
+		return msg
+	}
+	if msg, ok := catalogs[defaultLanguage][key]; ok {
+		return msg
+	}
+	return message{Text: key}
+}
+
+func (l localizer) T(key string, args ...interface{}) string {
+	msg := l.lookup(key)
+	if len(args) == 0 {
+		return msg.Text
+	}
+	return fmt.Sprintf(msg.Text, args...)
+}
+
+// N formats the form of a message that matches count, which is passed to
+// the message as its first argument.
+func (l localizer) N(key string, count int, args ...interface{}) string {
+	return fmt.Sprintf(l.Pattern(key, count), append([]interface{}{count}, args...)...)
+}
+
+// Pattern returns the unformatted form of a message for count, which
+// list.html hands to its script for updates that arrive over SSE.
+func (l localizer) Pattern(key string, count int) string {
+	msg := l.lookup(key)
+	if msg.Plural == nil {
+		return msg.Text
+	}
+	rule, ok := pluralRules[l.Lang]
+	if !ok {
+		rule = pluralRules[defaultLanguage]
+	}
+	if form, ok := msg.Plural[rule(count)]; ok {
+		return form
+	}
+	return msg.Plural["other"]
+}
+
+func (l localizer) Date(t time.Time) string {
+	months := strings.Split(l.T("date.months"), ",")
+	weekdays := strings.Split(l.T("date.weekdays"), ",")
+	if len(months) != 12 || len(weekdays) != 7 {
+		return t.Format("2006-01-02 15:04")
+	}
+	return strings.NewReplacer(
+		"{weekday}", weekdays[t.Weekday()],
+		"{month}", months[t.Month()-1],
+		"{day}", strconv.Itoa(t.Day()),
+		"{year}", strconv.Itoa(t.Year()),
+		"{time}", t.Format("15:04"),
+	).Replace(l.T("date.format"))
+}
+
+type language struct {
+	Code, Name string
+}
+
+func supportedLanguages() []language {
+	languages := []language{}
+	for code := range catalogs {
+		languages = append(languages, language{Code: code, Name: catalogs[code]["language.name"].Text})
+	}
+	sort.Slice(languages, func(i, j int) bool { return languages[i].Code < languages[j].Code })
+	return languages
+}
+
+const languageCookie = "lang"
+
+// localizerFor picks the language chosen with the switcher, which is kept in
+// a cookie, or else the best match for the Accept-Language header.
+func localizerFor(request *http.Request) localizer {
+	if cookie, err := request.Cookie(languageCookie); err == nil {
+		if _, ok := catalogs[cookie.Value]; ok {
+			return localizer{Lang: cookie.Value}
+		}
+	}
+	return localizer{Lang: negotiateLanguage(request.Header.Get("Accept-Language"))}
+}
+
+// negotiateLanguage returns the supported language with the highest quality
+// in an Accept-Language header such as "de-AT,de;q=0.9,en;q=0.5". Regional
+// variants match their base language.
+func negotiateLanguage(header string) string {
+	best, bestQuality := defaultLanguage, 0.0
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		quality := 1.0
+		for _, param := range fields[1:] {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if q, err := strconv.ParseFloat(value, 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		base, _, _ := strings.Cut(tag, "-")
+		if _, ok := catalogs[base]; ok && quality > bestQuality {
+			best, bestQuality = base, quality
+		}
+	}
+	return best
+}
+
+// languageHandler stores the language picked with the switcher in a cookie
+// and sends the guest back to the page they were on.
+func languageHandler(writer http.ResponseWriter, request *http.Request) {
+	lang := request.FormValue("lang")
+	if _, ok := catalogs[lang]; ok {
+		http.SetCookie(writer, &http.Cookie{
+			Name: languageCookie, Value: lang, Path: "/",
+			MaxAge: 365 * 24 * 60 * 60, SameSite: http.SameSiteLaxMode, Secure: request.TLS != nil,
+		})
+	}
+	http.Redirect(writer, request, localPath(request.FormValue("next")), http.StatusSeeOther)
+}
+
+// localPath returns next if it is a path on this site and "/" otherwise.
+// Browsers read a backslash as a slash, so /\evil.example leads to another
+// site just like //evil.example does. The result is rebuilt from the parsed
+// path and query, so nothing else in next reaches the Location header.
+func localPath(next string) string {
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Opaque != "" || u.User != nil ||
+		!strings.HasPrefix(next, "/") || strings.Contains(next, `\`) ||
+		!strings.HasPrefix(u.Path, "/") || strings.HasPrefix(u.Path, "//") || strings.Contains(u.Path, `\`) {
+		return "/"
+	}
+	return (&url.URL{Path: u.Path, RawQuery: u.RawQuery}).String()
+}
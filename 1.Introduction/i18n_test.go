@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestLocalPath(t *testing.T) {
+	tests := []struct{ next, want string }{
+		{"/", "/"},
+		{"/form", "/form"},
+		{"/list?lang=de", "/list?lang=de"},
+		{"/household?name=The%20Smiths", "/household?name=The%20Smiths"},
+		{"", "/"},
+		{"form", "/"},
+		{"//evil.example", "/"},
+		{`/\evil.example`, "/"},
+		{`\\evil.example`, "/"},
+		{`/form\..\..`, "/"},
+		{"/%5Cevil.example", "/"},
+		{"/%2Fevil.example", "/"},
+		{"https://evil.example/", "/"},
+		{"javascript:alert(1)", "/"},
+		{"/\t/evil.example", "/"},
+		{"/form#top", "/form"},
+	}
+	for _, test := range tests {
+		if got := localPath(test.next); got != test.want {
+			t.Errorf("localPath(%q) = %q, want %q", test.next, got, test.want)
+		}
+	}
+}
+
+func TestNegotiateLanguage(t *testing.T) {
+	tests := []struct{ header, want string }{
+		{"", defaultLanguage},
+		{"de", "de"},
+		{"fr-CA", "fr"},
+		{"DE-at,de;q=0.9,en;q=0.5", "de"},
+		{"en;q=0.5,fr;q=0.8", "fr"},
+		{"es,it;q=0.9", defaultLanguage},
+		{"es,de;q=0.1", "de"},
+		{"de;q=0,fr;q=0.2", "fr"},
+		{"de;q=abc", "de"},
+		{" fr ; q=0.7 , en ; q=0.6", "fr"},
+	}
+	for _, test := range tests {
+		if got := negotiateLanguage(test.header); got != test.want {
+			t.Errorf("negotiateLanguage(%q) = %q, want %q", test.header, got, test.want)
+		}
+	}
+}
+
+// TestCatalogsComplete checks that every language translates each message of
+// the default one.
+func TestCatalogsComplete(t *testing.T) {
+	for lang, catalog := range catalogs {
+		for key := range catalogs[defaultLanguage] {
+			if _, ok := catalog[key]; !ok {
+				t.Errorf("%v has no message %q", lang, key)
+			}
+		}
+	}
+}
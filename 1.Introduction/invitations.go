@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+type Invitation struct {
+	Name, Email, Phone, Group string
+	Sent                      bool
+}
+
+var invitations = make([]*Invitation, 0, 10)
+
+type importRow struct {
+	Line int
+	*Invitation
+	Errors []string
+}
+
+type importData struct {
+	Rows    []importRow
+	Valid   int
+	Created int
+	Errors  []string
+}
+
+// validateInvitation applies the same rules formHandler uses for an RSVP,
+// plus a check that the email address has not been invited already. Members
+// of a group only need a name, because the household form asks whoever
+// answers for an email address and phone number, and they may share an email
+// address with each other but not with anyone outside the group. Their names
+// must differ, since answers are matched to members by name. seen holds the
+// email addresses and members of the rows before this one.
+func validateInvitation(inv *Invitation, seen map[string]string) []string {
+	errors := []string{}
+	if inv.Group == "" {
+		errors = validateRsvp(&Rsvp{Name: inv.Name, Email: inv.Email, Phone: inv.Phone}, english)
+	} else if inv.Name == "" {
+		errors = append(errors, english.T("error.name"))
+	}
+	group := strings.ToLower(inv.Group)
+	if inv.Email != "" {
+		key := "email\n" + strings.ToLower(inv.Email)
+		taken := false
+		if other, ok := seen[key]; ok {
+			taken = group == "" || other != group
+		}
+		for _, existing := range invitations {
+			if strings.EqualFold(existing.Email, inv.Email) && (group == "" || !strings.EqualFold(existing.Group, inv.Group)) {
+				taken = true
+			}
+		}
+		if taken {
+			errors = append(errors, "This email address has already been invited")
+		}
+		seen[key] = group
+	}
+	if group != "" && inv.Name != "" {
+		key := "member\n" + group + "\n" + inv.Name
+		_, taken := seen[key]
+		for _, existing := range invitations {
+			if strings.EqualFold(existing.Group, inv.Group) && existing.Name == inv.Name {
+				taken = true
+			}
+		}
+		if taken {
+			errors = append(errors, "This group already has a member with this name")
+		}
+		seen[key] = group
+	}
+	return errors
+}
+
+// parseGuestList reads name, email, phone and group columns from a CSV file.
+// A header row is skipped if present and the group column is optional.
+func parseGuestList(reader io.Reader) ([]importRow, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	csvReader.TrimLeadingSpace = true
+	rows := []importRow{}
+	seen := map[string]string{}
+	for line := 1; ; line++ {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		// Spreadsheets saving "CSV UTF-8" start the file with a byte order mark.
+		if line == 1 && len(record) > 0 {
+			record[0] = strings.TrimPrefix(record[0], "\ufeff")
+			if strings.EqualFold(strings.TrimSpace(record[0]), "name") {
+				continue
+			}
+		}
+		for len(record) < 4 {
+			record = append(record, "")
+		}
+		inv := &Invitation{
+			Name:  strings.TrimSpace(record[0]),
+			Email: strings.TrimSpace(record[1]),
+			Phone: strings.TrimSpace(record[2]),
+			Group: strings.TrimSpace(record[3]),
+		}
+		rowErrors := validateInvitation(inv, seen)
+		if len(record) > 4 {
+			rowErrors = append(rowErrors, fmt.Sprintf("Expected 4 columns but found %v", len(record)))
+		}
+		rows = append(rows, importRow{Line: line, Invitation: inv, Errors: rowErrors})
+	}
+	return rows, nil
+}
+
+func importHandler(writer http.ResponseWriter, request *http.Request) {
+	lockStore()
+	defer unlockStore()
+	if request.Method == http.MethodGet {
+		renderTemplate(writer, request, http.StatusOK, "import", importData{})
+	} else if request.Method == http.MethodPost {
+		if request.FormValue("action") == "create" {
+			createInvitations(writer, request)
+			return
+		}
+		file, _, err := request.FormFile("guests")
+		if err != nil {
+			renderTemplate(writer, request, http.StatusBadRequest, "import", importData{
+				Errors: []string{"Please choose a CSV file to upload"},
+			})
+			return
+		}
+		defer file.Close()
+		rows, err := parseGuestList(file)
+		if err != nil {
+			renderTemplate(writer, request, http.StatusBadRequest, "import", importData{
+				Errors: []string{"The file could not be read as CSV: " + err.Error()},
+			})
+			return
+		}
+		data := importData{Rows: rows}
+		for _, row := range rows {
+			if len(row.Errors) == 0 {
+				data.Valid++
+			}
+		}
+		renderTemplate(writer, request, http.StatusOK, "import", data)
+	}
+}
+
+// createInvitations stores the rows confirmed on the preview page. The rows
+// are validated again because the preview is only a form the host submits.
+func createInvitations(writer http.ResponseWriter, request *http.Request) {
+	request.ParseForm()
+	names, emails := request.Form["name"], request.Form["email"]
+	phones, groups := request.Form["phone"], request.Form["group"]
+	sendEmails := request.Form.Get("sendemails") == "true"
+	data := importData{}
+	seen := map[string]string{}
+	before := captureStore()
+	for i := range names {
+		if i >= len(emails) || i >= len(phones) || i >= len(groups) {
+			break
+		}
+		inv := &Invitation{Name: names[i], Email: emails[i], Phone: phones[i], Group: groups[i]}
+		if rowErrors := validateInvitation(inv, seen); len(rowErrors) > 0 {
+			data.Rows = append(data.Rows, importRow{Line: i + 1, Invitation: inv, Errors: rowErrors})
+			continue
+		}
+		inv.Sent = sendEmails && inv.Email != ""
+		invitations = append(invitations, inv)
+		data.Created++
+	}
+	if err := saveChange(before); err != nil {
+		loggerFor(request).Error("failed to save invitations", "error", err)
+		showError(writer, request, http.StatusInternalServerError, "error.save-invitations")
+		return
+	}
+	loggerFor(request).Info("invitations imported", "created", data.Created, "rejected", len(data.Rows), "send_emails", sendEmails)
+	if sendEmails {
+		for _, inv := range invitations[len(invitations)-data.Created:] {
+			sendInvitation(inv)
+		}
+	}
+	renderTemplate(writer, request, http.StatusOK, "import", data)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseGuestListByteOrderMark(t *testing.T) {
+	invitations = nil
+	rows, err := parseGuestList(strings.NewReader("\ufeffname,email,phone,group\nAnn,ann@example.org,1,\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Name != "Ann" || len(rows[0].Errors) != 0 {
+		t.Errorf("parseGuestList = %+v, want only Ann", rows)
+	}
+	rows, err = parseGuestList(strings.NewReader("\ufeffAnn,ann@example.org,1,\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Name != "Ann" {
+		t.Errorf("parseGuestList without a header = %+v, want Ann", rows)
+	}
+}
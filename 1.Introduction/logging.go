@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+)
+
+// setupLogging makes the default slog logger write text or JSON to stderr,
+// depending on the configured log format.
+func setupLogging(format, level string) {
+	options := &slog.HandlerOptions{}
+	options.Level = map[string]slog.Level{
+		"debug": slog.LevelDebug, "info": slog.LevelInfo, "warn": slog.LevelWarn, "error": slog.LevelError,
+	}[level]
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if format == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+type loggerContextKey struct{}
+
+// loggerFor returns a logger that adds the request ID to every entry, so
+// RSVP events can be matched with the access log line for the request.
+func loggerFor(request *http.Request) *slog.Logger {
+	if logger, ok := request.Context().Value(loggerContextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// statusRecorder remembers the status and size of a response for the access
+// log. Unwrap lets http.ResponseController reach the underlying writer, which
+// the SSE handler needs for flushing and deadlines.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(data)
+	r.bytes += n
+	return n, err
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func clientIP(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// probePaths are polled by the orchestrator and only logged at debug level.
+var probePaths = map[string]bool{"/healthz": true, "/readyz": true}
+
+// logRequests gives every request an ID, taken from X-Request-ID when a
+// proxy supplies a sensible one, and writes an access log entry when the
+// request is finished.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		id := request.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		writer.Header().Set("X-Request-ID", id)
+		logger := slog.Default().With("request_id", id)
+		request = request.WithContext(context.WithValue(request.Context(), loggerContextKey{}, logger))
+		recorder := &statusRecorder{ResponseWriter: writer}
+		next.ServeHTTP(recorder, request)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if probePaths[request.URL.Path] {
+			level = slog.LevelDebug
+		}
+		logger.Log(request.Context(), level, "request",
+			"method", request.Method,
+			"path", request.URL.Path,
+			"status", recorder.status,
+			"bytes", recorder.bytes,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"client_ip", clientIP(request),
+		)
+	})
+}
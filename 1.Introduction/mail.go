@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// When no SMTP host is configured, messages are printed to the console
+// instead of being sent.
+type mailConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+}
+
+type mailMessage struct {
+	To, Subject, Body string
+}
+
+// mailQueue holds the messages waiting for the mail worker. It is a slice
+// rather than a channel so that a guest's messages can be looked at and
+// removed before they are sent. mailWake tells the worker that there is
+// something to do.
+var (
+	mailLock    sync.Mutex
+	mailQueue   []mailMessage
+	mailStopped bool
+	mailWake    = make(chan struct{}, 1)
+	mailDone    = make(chan struct{})
+)
+
+// nextMail waits for a queued message. It returns false once the queue has
+// been stopped and is empty.
+func nextMail() (mailMessage, bool) {
+	for {
+		mailLock.Lock()
+		if len(mailQueue) > 0 {
+			msg := mailQueue[0]
+			mailQueue = mailQueue[1:]
+			mailLock.Unlock()
+			return msg, true
+		}
+		stopped := mailStopped
+		mailLock.Unlock()
+		if stopped {
+			return mailMessage{}, false
+		}
+		<-mailWake
+	}
+}
+
+func wakeMailWorker() {
+	select {
+	case mailWake <- struct{}{}:
+	default:
+	}
+}
+
+func mailWorker() {
+	defer close(mailDone)
+	for {
+		msg, ok := nextMail()
+		if !ok {
+			return
+		}
+		if err := sendMail(msg); err != nil {
+			slog.Error("failed to send mail", "to", msg.To, "subject", msg.Subject, "error", err)
+			mailResults.inc("failed")
+		} else {
+			slog.Info("mail sent", "to", msg.To, "subject", msg.Subject)
+			mailResults.inc("sent")
+		}
+	}
+}
+
+// queueMail hands a message to the mail worker.
+func queueMail(msg mailMessage) {
+	mailLock.Lock()
+	defer mailLock.Unlock()
+	if mailStopped {
+		slog.Warn("mail dropped during shutdown", "to", msg.To, "subject", msg.Subject)
+		mailResults.inc("dropped")
+		return
+	}
+	mailQueue = append(mailQueue, msg)
+	wakeMailWorker()
+}
+
+// queuedMail returns the messages to an address that have not been sent yet.
+func queuedMail(to string) []mailMessage {
+	mailLock.Lock()
+	defer mailLock.Unlock()
+	matching := []mailMessage{}
+	for _, msg := range mailQueue {
+		if strings.EqualFold(msg.To, to) {
+			matching = append(matching, msg)
+		}
+	}
+	return matching
+}
+
+// removeMail takes the messages to an address out of the queue and returns
+// how many there were. A message that is already being sent is not stopped.
+func removeMail(to string) int {
+	mailLock.Lock()
+	defer mailLock.Unlock()
+	kept := []mailMessage{}
+	for _, msg := range mailQueue {
+		if !strings.EqualFold(msg.To, to) {
+			kept = append(kept, msg)
+		}
+	}
+	removed := len(mailQueue) - len(kept)
+	mailQueue = kept
+	for i := 0; i < removed; i++ {
+		mailResults.inc("removed")
+	}
+	return removed
+}
+
+// stopMail stops accepting messages and waits for the worker to send the
+// messages that are already queued, or for the context to expire.
+func stopMail(ctx context.Context) error {
+	mailLock.Lock()
+	mailStopped = true
+	mailLock.Unlock()
+	wakeMailWorker()
+	select {
+	case <-mailDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func sendMail(msg mailMessage) error {
+	if config.Mail.Host == "" {
+		fmt.Printf("Mail to %v: %v\n%v\n", msg.To, msg.Subject, msg.Body)
+		return nil
+	}
+	var auth smtp.Auth
+	if config.Mail.Username != "" {
+		auth = smtp.PlainAuth("", config.Mail.Username, config.Mail.Password, config.Mail.Host)
+	}
+	body := strings.Join([]string{
+		"From: " + config.Mail.From,
+		"To: " + msg.To,
+		"Subject: " + msg.Subject,
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		msg.Body,
+	}, "\r\n")
+	addr := fmt.Sprintf("%v:%v", config.Mail.Host, config.Mail.Port)
+	return smtp.SendMail(addr, auth, config.Mail.From, []string{msg.To}, []byte(body))
+}
+
+// sendInvitation mails an invitation. Household members without an email
+// address of their own are reached through the invitations of the others.
+func sendInvitation(inv *Invitation) {
+	if inv.Email == "" {
+		return
+	}
+	link := config.BaseURL + "/form"
+	if inv.Group != "" {
+		link = config.BaseURL + "/household?name=" + url.QueryEscape(inv.Group)
+	}
+	queueMail(mailMessage{
+		To:      inv.Email,
+		Subject: "You're invited to the party!",
+		Body: fmt.Sprintf("Hi %v,\n\nWe're going to have an exciting party and you are invited!\n"+
+			"Please let us know if you can make it: %v\n", inv.Name, link),
+	})
+}
+
+func sendPrivacyLink(email, link string) {
+	queueMail(mailMessage{
+		To:      email,
+		Subject: "Your data for the party",
+		Body: fmt.Sprintf("Hi,\n\nSomeone, hopefully you, asked to see or delete the data we keep for this address.\n"+
+			"Use this link within a day: %v\n\nIf it wasn't you, you can ignore this message.\n", link),
+	})
+}
+
+func sendChangeLink(email, link string) {
+	queueMail(mailMessage{
+		To:      email,
+		Subject: "Change your RSVP",
+		Body: fmt.Sprintf("Hi,\n\nSomeone, hopefully you, tried to change the RSVP given for this address.\n"+
+			"Use this link within a day to change it: %v\n\nIf it wasn't you, you can ignore this message and your answer stays as it is.\n", link),
+	})
+}
+
+func sendPromotion(rsvp *Rsvp) {
+	if rsvp.Email == "" {
+		return
+	}
+	queueMail(mailMessage{
+		To:      rsvp.Email,
+		Subject: "A place has opened up at the party!",
+		Body: fmt.Sprintf("Hi %v,\n\nGood news: a place has opened up and you are off the waitlist.\n"+
+			"See who else is coming: %v/list\n", rsvp.Name, config.BaseURL),
+	})
+}
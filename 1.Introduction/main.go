@@ -1,98 +1,481 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
+	"log/slog"
 	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type Rsvp struct {
-	Name, Email, Phone string
-	WillAttend         bool
+	Name, Email, Phone, Household string
+	WillAttend, Waitlisted        bool
+	PlusOnes                      int
+	// Created is when the guest first answered and Updated when they last
+	// changed their answer.
+	Created, Updated time.Time
+	Source           string
+	UserAgent        string
 }
 
+// The sources of a response, recorded so the host can tell answers that
+// guests gave themselves from those entered for them.
+const (
+	sourceWeb   = "web"
+	sourceAdmin = "admin"
+)
+
+// maxUserAgent bounds the user agent kept with a response, which clients
+// can make as long as they like.
+const maxUserAgent = 256
+
+// fromRequest records that a response was given on the site by the browser
+// making the request.
+func (rsvp *Rsvp) fromRequest(request *http.Request) {
+	rsvp.Source = sourceWeb
+	rsvp.UserAgent = request.UserAgent()
+	if len(rsvp.UserAgent) > maxUserAgent {
+		rsvp.UserAgent = strings.ToValidUTF8(rsvp.UserAgent[:maxUserAgent], "")
+	}
+}
+
+const maxPlusOnes = 5
+
+// shutdownTimeout bounds how long the server waits for requests in flight
+// and queued mail when it is asked to stop.
+const shutdownTimeout = 20 * time.Second
+
 var responses = make([]*Rsvp, 0, 10)
-var templates = make(map[string]*template.Template, 3)
 
 func welcomeHandler(writer http.ResponseWriter, request *http.Request) {
-	templates["welcome"].Execute(writer, nil)
+	renderTemplate(writer, request, http.StatusOK, "welcome", config.Event)
 }
 
 func listHandler(writer http.ResponseWriter, request *http.Request) {
-	templates["list"].Execute(writer, responses)
+	lockStore()
+	defer unlockStore()
+	renderTemplate(writer, request, http.StatusOK, "list", groupByHousehold(responses))
 }
 
 type formData struct {
 	*Rsvp
+	Token  string
 	Errors []string
 }
 
+func (data formData) PlusOneChoices() []int {
+	choices := make([]int, maxPlusOnes+1)
+	for i := range choices {
+		choices[i] = i
+	}
+	return choices
+}
+
+func validateRsvp(rsvp *Rsvp, loc localizer) []string {
+	errors := []string{}
+	if rsvp.Name == "" {
+		errors = append(errors, loc.T("error.name"))
+	}
+	if rsvp.Email == "" {
+		errors = append(errors, loc.T("error.email"))
+	}
+	if rsvp.Phone == "" {
+		errors = append(errors, loc.T("error.phone"))
+	}
+	if rsvp.PlusOnes < 0 || rsvp.PlusOnes > maxPlusOnes {
+		errors = append(errors, loc.N("error.plusones", maxPlusOnes))
+	}
+	return errors
+}
+
+// headcount returns the number of confirmed guests, including plus-ones,
+// leaving out the response that is about to be replaced.
+func headcount(except *Rsvp) int {
+	count := 0
+	for _, rsvp := range responses {
+		if rsvp != except && rsvp.WillAttend && !rsvp.Waitlisted {
+			count += 1 + rsvp.PlusOnes
+		}
+	}
+	return count
+}
+
+// admit stamps a new or changed response and decides whether it fits or goes
+// on the waitlist. The creation time of the response it replaces is kept.
+func admit(rsvp *Rsvp, replacing *Rsvp) {
+	now := time.Now()
+	rsvp.Created, rsvp.Updated = now, now
+	if replacing != nil && !replacing.Created.IsZero() {
+		rsvp.Created = replacing.Created
+	}
+	capacity := config.Event.Capacity
+	rsvp.Waitlisted = rsvp.WillAttend && capacity > 0 &&
+		headcount(replacing)+1+rsvp.PlusOnes > capacity
+}
+
+// A promotion is a guest who was moved off the waitlist, with their answer
+// as it was before.
+type promotion struct {
+	before Rsvp
+	rsvp   *Rsvp
+}
+
+// promoteWaitlist confirms waitlisted guests, in the order they answered,
+// while there is room for them and their plus-ones. It only changes the
+// responses: the caller passes the promotions to announcePromotions once the
+// store has been saved, so nobody is told about a place that was not kept.
+func promoteWaitlist() []promotion {
+	promotions := []promotion{}
+	capacity := config.Event.Capacity
+	for _, rsvp := range responses {
+		if rsvp.Waitlisted && (capacity == 0 || headcount(nil)+1+rsvp.PlusOnes <= capacity) {
+			promotions = append(promotions, promotion{before: *rsvp, rsvp: rsvp})
+			rsvp.Waitlisted = false
+		}
+	}
+	return promotions
+}
+
+// announcePromotions records saved promotions in the audit log, updates the
+// list and mails the guests.
+func announcePromotions(promotions []promotion) {
+	for _, p := range promotions {
+		recordChange(systemSource, auditPromote, &p.before, p.rsvp)
+		slog.Info("RSVP promoted from waitlist", "email", p.rsvp.Email, "plus_ones", p.rsvp.PlusOnes)
+		publishGroup(p.rsvp)
+		sendPromotion(p.rsvp)
+	}
+}
+
+// findResponse returns the answer a guest gave for themselves, or nil.
+func findResponse(email string) *Rsvp {
+	for _, rsvp := range responses {
+		if rsvp.Household == "" && strings.EqualFold(rsvp.Email, email) {
+			return rsvp
+		}
+	}
+	return nil
+}
+
+// saveResponse replaces an earlier answer from the same guest, so a guest
+// who changes their mind appears only once on the list. It returns the
+// answer that was replaced, or nil, and the promotions the change allowed.
+// Guests on the site may only replace an answer with a mailed link, which
+// formHandler checks with mayReplace.
+func saveResponse(rsvp *Rsvp) (*Rsvp, []promotion) {
+	for i, existing := range responses {
+		if existing.Household == "" && strings.EqualFold(existing.Email, rsvp.Email) {
+			admit(rsvp, existing)
+			responses[i] = rsvp
+			return existing, promoteWaitlist()
+		}
+	}
+	admit(rsvp, nil)
+	responses = append(responses, rsvp)
+	return nil, nil
+}
+
+// mayReplace reports whether a request carries a link mailed to the email
+// address, which a guest needs to change an answer they already gave. Without
+// it, anyone who knows a guest's address could change their answer.
+func mayReplace(request *http.Request, email string) bool {
+	linkEmail, err := checkPrivacyToken(request.Form.Get("token"))
+	return err == nil && strings.EqualFold(linkEmail, email)
+}
+
+// mailChangeLink sends a guest who has already answered a link to the form
+// that lets them change their answer.
+func mailChangeLink(request *http.Request, email string) {
+	if !allowLink("change", email) {
+		return
+	}
+	token, err := newPrivacyToken(email)
+	if err != nil {
+		loggerFor(request).Error("failed to sign change link", "error", err)
+		return
+	}
+	sendChangeLink(email, config.BaseURL+"/form?token="+url.QueryEscape(token))
+}
+
 func formHandler(writer http.ResponseWriter, request *http.Request) {
 	if request.Method == http.MethodGet {
-		templates["form"].Execute(writer, formData{
-			Rsvp: &Rsvp{}, Errors: []string{},
-		})
+		data := formData{Rsvp: &Rsvp{}, Errors: []string{}}
+		if token := request.FormValue("token"); token != "" {
+			email, ok := privacyRequest(writer, request)
+			if !ok {
+				return
+			}
+			data.Rsvp.Email, data.Token = email, token
+			lockStore()
+			if existing := findResponse(email); existing != nil {
+				answer := *existing
+				data.Rsvp = &answer
+			}
+			unlockStore()
+		}
+		renderTemplate(writer, request, http.StatusOK, "form", data)
 	} else if request.Method == http.MethodPost {
-		request.ParseForm()
-		responseData := Rsvp{
-			Name:       request.Form["name"][0],
-			Email:      request.Form["email"][0],
-			Phone:      request.Form["phone"][0],
-			WillAttend: request.Form["willattend"][0] == "true",
+		if err := request.ParseForm(); err != nil {
+			showError(writer, request, http.StatusBadRequest, "error.bad-request")
+			return
 		}
-		errors := []string{}
-		if responseData.Name == "" {
-			errors = append(errors, "Please enter your name")
+		plusOnes, err := strconv.Atoi(request.Form.Get("plusones"))
+		willAttend := request.Form.Get("willattend")
+		responseData := Rsvp{
+			Name:       request.Form.Get("name"),
+			Email:      request.Form.Get("email"),
+			Phone:      request.Form.Get("phone"),
+			WillAttend: willAttend == "true",
+			PlusOnes:   plusOnes,
 		}
-		if responseData.Email == "" {
-			errors = append(errors, "Please enter your email address")
+		responseData.fromRequest(request)
+		loc := localizerFor(request)
+		errors := validateRsvp(&responseData, loc)
+		if willAttend != "true" && willAttend != "false" {
+			errors = append(errors, loc.T("error.willattend"))
 		}
-		if responseData.Phone == "" {
-			errors = append(errors, "Please enter your phone number")
+		if err != nil {
+			errors = append(errors, loc.T("error.plusones-choice"))
 		}
 		if len(errors) > 0 {
-			templates["form"].Execute(writer, formData{
-				Rsvp: &responseData, Errors: errors,
+			renderTemplate(writer, request, http.StatusUnprocessableEntity, "form", formData{
+				Rsvp: &responseData, Token: request.Form.Get("token"), Errors: errors,
 			})
 		} else {
-			responses = append(responses, &responseData)
-			if responseData.WillAttend {
-				templates["thanks"].Execute(writer, responseData.Name)
+			lockStore()
+			defer unlockStore()
+			if findResponse(responseData.Email) != nil && !mayReplace(request, responseData.Email) {
+				loggerFor(request).Info("RSVP change needs a mailed link", "email", responseData.Email)
+				mailChangeLink(request, responseData.Email)
+				renderTemplate(writer, request, http.StatusConflict, "form", formData{
+					Rsvp: &responseData, Errors: []string{loc.T("error.answered")},
+				})
+				return
+			}
+			before := captureStore()
+			previous, promotions := saveResponse(&responseData)
+			if err := saveChange(before); err != nil {
+				loggerFor(request).Error("failed to save RSVP", "email", responseData.Email, "error", err)
+				showError(writer, request, http.StatusInternalServerError, "error.save-rsvp")
+				return
+			}
+			recordChange(guestSource(request, responseData.Email), "", previous, &responseData)
+			announcePromotions(promotions)
+			loggerFor(request).Info("RSVP saved", "email", responseData.Email, "updated", previous != nil,
+				"attending", responseData.WillAttend, "waitlisted", responseData.Waitlisted, "plus_ones", responseData.PlusOnes)
+			publishGroup(&responseData)
+			if responseData.Waitlisted {
+				renderTemplate(writer, request, http.StatusOK, "waitlist", responseData.Name)
+			} else if responseData.WillAttend {
+				renderTemplate(writer, request, http.StatusOK, "thanks", responseData.Name)
 			} else {
-				templates["sorry"].Execute(writer, responseData.Name)
+				renderTemplate(writer, request, http.StatusOK, "sorry", responseData.Name)
 			}
 		}
 	}
 }
 
-func loadTemplates() {
-	templateNames := [5]string{"welcome", "form", "thanks", "sorry", "list"}
-	for index, name := range templateNames {
-		t, err := template.ParseFiles("layout.html", name+".html")
-		if err == nil {
-			templates[name] = t
-			fmt.Println("Loaded template", index, name)
-		} else {
-			panic(err)
+var templateNames = [14]string{"welcome", "form", "thanks", "sorry", "waitlist", "list", "import", "household", "dashboard", "guests", "theme", "audit", "privacy", "error"}
+
+// templateFuncs are available to every template. Those that depend on the
+// request are placeholders here and are replaced by requestFuncs.
+var templateFuncs = template.FuncMap{
+	"asset":      assetPath,
+	"languages":  supportedLanguages,
+	"csrf":       csrfToken,
+	"theme":      func() Theme { return currentTheme() },
+	"lang":       func() string { return english.Lang },
+	"t":          english.T,
+	"tn":         english.N,
+	"pattern":    english.Pattern,
+	"date":       english.Date,
+	"currentURL": func() string { return "/" },
+	"nonce":      func() string { return "" },
+}
+
+func parseTemplates() (map[string]*template.Template, error) {
+	resetFingerprints()
+	parsed := make(map[string]*template.Template, len(templateNames))
+	for _, name := range templateNames {
+		t, err := template.New("layout.html").Funcs(templateFuncs).
+			ParseFS(templateFS(), "layout.html", name+".html")
+		if err != nil {
+			return nil, err
 		}
+		parsed[name] = t
 	}
+	return parsed, nil
+}
 
+// loadTemplates parses the templates at startup. A failure is logged and
+// reported by /readyz rather than stopping the server, and pages show an
+// error until the templates are fixed.
+func loadTemplates() {
+	parsed, err := parseTemplates()
+	setTemplates(parsed, err)
+	if err != nil {
+		slog.Error("failed to load templates", "error", err)
+		return
+	}
+	for index, name := range templateNames {
+		slog.Debug("loaded template", "index", index, "name", name)
+	}
 }
 
+// main runs the command named by the first argument, or the server when the
+// arguments start with a flag or there are none.
 func main() {
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		printUsage(os.Stdout)
+		return
+	}
+	run, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		printUsage(os.Stderr)
+		os.Exit(2)
+	}
+	if err := run(args); errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func serveCommand(args []string) error {
+	cfg, err := loadConfig(flag.NewFlagSet("partyinvites serve", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	config = cfg
+	setupLogging(config.LogFormat, config.LogLevel)
+	if err := loadStore(); err != nil {
+		slog.Error("failed to load RSVPs, changes will not be saved", "path", storePath(), "error", err)
+		setStoreLoadError(err)
+	}
 	loadTemplates()
+	checkVendoredAssets()
+	warnHostDisabled()
+	if config.Dev {
+		startWorker("templates", func() { watchTemplates(config.TemplateDir) })
+	}
 
-	fileServer := http.FileServer(http.Dir("./static"))
-	http.Handle("/assets/", http.StripPrefix("/assets", fileServer))
+	router := newRouter()
+	router.handlePrefix("/assets/", assetHandler(), http.MethodGet)
 	mime.AddExtensionType(".css", "text/css; charset=utf-8")
 
-	http.HandleFunc("/", welcomeHandler)
-	http.HandleFunc("/list", listHandler)
-	http.HandleFunc("/form", formHandler)
+	get, post := http.MethodGet, http.MethodPost
+	router.handleFunc("/", welcomeHandler, get)
+	router.handleFunc("/list", listHandler, get)
+	router.handleFunc("/list/events", eventsHandler, get)
+	router.handleFunc("/form", formHandler, get, post)
+	router.handleFunc("/language", languageHandler, get)
+	router.handleFunc("/household", householdHandler, get, post)
+	router.handleFunc("/privacy", privacyHandler, get, post)
+	router.handleFunc("/privacy/manage", privacyManageHandler, get)
+	router.handleFunc("/privacy/export", privacyExportHandler, get)
+	router.handleFunc("/privacy/delete", privacyDeleteHandler, post)
+	router.handleFunc("/host/import", hostOnly(importHandler), get, post)
+	router.handleFunc("/host/dashboard", hostOnly(dashboardHandler), get)
+	router.handleFunc("/host/guests", hostOnly(guestsHandler), get)
+	router.handleFunc("/host/audit", hostOnly(auditHandler), get)
+	router.handleFunc("/host/audit/export", hostOnly(auditExportHandler), get)
+	router.handleFunc("/host/theme", hostOnly(themeHandler), get, post)
+	router.handleFunc("/host/theme/preview", hostOnly(themePreviewHandler), get)
+	router.handlePrefix("/theme/", http.HandlerFunc(themeImageHandler), get)
+	router.handleFunc("/metrics", metricsHandler, get)
+	router.handleFunc("/healthz", healthzHandler, get)
+	router.handleFunc("/readyz", readyzHandler, get)
 
-	err := http.ListenAndServe(":5000", nil)
-	if err != nil {
-		fmt.Println(err)
+	startWorker("mail", mailWorker)
+	if config.Event.RetentionDays > 0 {
+		startWorker("retention", retentionWorker)
+	}
+
+	server := &http.Server{
+		Addr:              config.Addr,
+		Handler:           logRequests(strictTransport(secureHeaders(instrument(router)))),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	server.RegisterOnShutdown(rsvpBroker.close)
+	certFile, keyFile := config.TLS.certFiles()
+	if config.TLS.SelfSigned {
+		if err := ensureSelfSigned(certFile, keyFile); err != nil {
+			return fmt.Errorf("failed to create self-signed certificate: %w", err)
+		}
+	}
+	if config.TLS.Enabled() {
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	redirectServer := &http.Server{
+		Addr:              config.TLS.RedirectAddr,
+		Handler:           logRequests(http.HandlerFunc(redirectToHTTPS)),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       time.Minute,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serveErr := make(chan error, 2)
+	go func() {
+		if config.TLS.Enabled() {
+			slog.Info("listening", "addr", config.Addr, "tls", true)
+			serveErr <- server.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			slog.Info("listening", "addr", config.Addr, "tls", false)
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+	if config.TLS.RedirectAddr != "" {
+		go func() {
+			slog.Info("redirecting HTTP to HTTPS", "addr", config.TLS.RedirectAddr)
+			serveErr <- redirectServer.ListenAndServe()
+		}()
+	}
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+		stop()
+	}
+
+	slog.Info("shutting down, press Ctrl+C again to exit immediately")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("connections did not drain in time", "error", err)
+	}
+	redirectServer.Shutdown(shutdownCtx)
+	if err := stopMail(shutdownCtx); err != nil {
+		slog.Warn("queued mail was not sent", "error", err)
+	}
+	lockStore()
+	defer unlockStore()
+	if err := saveStore(); err != nil {
+		return fmt.Errorf("failed to save RSVPs: %w", err)
 	}
+	slog.Info("stopped")
+	return nil
 }
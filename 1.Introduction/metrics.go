@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The metrics below are written in the Prometheus text format by
+// metricsHandler. They are kept by hand rather than with the Prometheus
+// client library, since the server has no dependencies outside the standard
+// library.
+
+// A counter keeps one value per combination of label values.
+type counter struct {
+	name, help string
+	labels     []string
+	mutex      sync.Mutex
+	values     map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	return &counter{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counter) inc(labelValues ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[labelKey(labelValues)]++
+}
+
+func (c *counter) write(writer io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	fmt.Fprintf(writer, "# HELP %v %v\n# TYPE %v counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(writer, "%v%v %v\n", c.name, formatLabels(c.labels, key, ""), formatValue(c.values[key]))
+	}
+}
+
+// A histogram counts observations, such as durations in seconds, into
+// cumulative buckets per combination of label values.
+type histogram struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mutex      sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// latencyBuckets suit requests and file writes, which should take a few
+// milliseconds and are worth noticing above a second.
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogram {
+	return &histogram{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}}
+}
+
+func (h *histogram) observe(value float64, labelValues ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	key := labelKey(labelValues)
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+func (h *histogram) write(writer io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	fmt.Fprintf(writer, "# HELP %v %v\n# TYPE %v histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(writer, "%v_bucket%v %v\n", h.name, formatLabels(h.labels, key, formatValue(bound)), series.counts[i])
+		}
+		fmt.Fprintf(writer, "%v_bucket%v %v\n", h.name, formatLabels(h.labels, key, "+Inf"), series.count)
+		fmt.Fprintf(writer, "%v_sum%v %v\n", h.name, formatLabels(h.labels, key, ""), formatValue(series.sum))
+		fmt.Fprintf(writer, "%v_count%v %v\n", h.name, formatLabels(h.labels, key, ""), series.count)
+	}
+}
+
+// labelKey joins label values with a byte that cannot appear in valid UTF-8,
+// so the values can be split again when the metric is written.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels turns a label key back into {name="value",...}, adding the
+// histogram bucket bound as le when it is not empty.
+func formatLabels(names []string, key, le string) string {
+	pairs := []string{}
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%v=%v", names[i], quoteLabel(value)))
+		}
+	}
+	if le != "" {
+		pairs = append(pairs, "le="+quoteLabel(le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func quoteLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	httpRequests = newCounter("partyinvites_http_requests_total",
+		"HTTP requests by route, method and status code.", "route", "method", "status")
+	httpDuration = newHistogram("partyinvites_http_request_duration_seconds",
+		"Time taken to answer HTTP requests by route and method.", latencyBuckets, "route", "method")
+	renderErrors = newCounter("partyinvites_template_render_errors_total",
+		"Templates that failed to render, by template name.", "template")
+	mailResults = newCounter("partyinvites_mail_total",
+		"Emails by outcome: sent, failed, dropped during shutdown or removed at a guest's request.", "result")
+	storeWrites = newHistogram("partyinvites_store_write_duration_seconds",
+		"Time taken to write the RSVP store to disk.", latencyBuckets)
+	storeWriteErrors = newCounter("partyinvites_store_write_errors_total",
+		"Writes of the RSVP store that failed.")
+)
+
+// metricMethods are the methods used as label values; anything else is
+// counted as "other" so clients cannot create new series at will.
+var metricMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodOptions: true,
+}
+
+// instrument counts the requests answered by the router and how long they
+// took. Requests are labeled with the route they matched rather than their
+// path, which keeps the number of series small.
+func instrument(r *router) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: writer}
+		r.ServeHTTP(recorder, request)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		route := r.route(request.URL.Path)
+		if route == "" {
+			route = "unmatched"
+		}
+		method := request.Method
+		if !metricMethods[method] {
+			method = "other"
+		}
+		httpRequests.inc(route, method, strconv.Itoa(recorder.status))
+		httpDuration.observe(time.Since(start).Seconds(), route, method)
+	})
+}
+
+// writeRsvpCounts reports the current number of guests in each status,
+// including invited guests who have not answered yet.
+func writeRsvpCounts(writer io.Writer) {
+	lockStore()
+	counts := map[string]int{}
+	for _, guest := range allGuests() {
+		counts[guest.Status]++
+	}
+	unlockStore()
+	fmt.Fprint(writer, "# HELP partyinvites_rsvps Guests by RSVP status.\n# TYPE partyinvites_rsvps gauge\n")
+	for _, status := range [4]string{statusAttending, statusDeclined, statusPending, statusWaitlist} {
+		fmt.Fprintf(writer, "partyinvites_rsvps{status=%q} %v\n", status, counts[status])
+	}
+}
+
+func metricsHandler(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	httpRequests.write(writer)
+	httpDuration.write(writer)
+	writeRsvpCounts(writer)
+	renderErrors.write(writer)
+	mailResults.write(writer)
+	storeWrites.write(writer)
+	storeWriteErrors.write(writer)
+}
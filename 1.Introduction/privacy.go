@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Guests can see and delete the data kept about them without the host's
+// help. They ask for a link on /privacy, which is mailed to the address they
+// give, and the link carries a token signed with a key from the data
+// directory that proves they can read mail sent there. The key is not part
+// of backups, so links sent before a restore stop working.
+
+// privacyLinkLifetime is how long a mailed link can be used.
+const privacyLinkLifetime = 24 * time.Hour
+
+// privacyLinkInterval limits how often a link is mailed to one address, so
+// the form cannot be used to flood a guest's inbox.
+const privacyLinkInterval = 10 * time.Minute
+
+var (
+	privacyLock   sync.Mutex
+	privacyKeyVal []byte
+	linksSent     = map[string]time.Time{}
+)
+
+func privacyKeyPath() string {
+	return filepath.Join(config.DataDir, "privacy.key")
+}
+
+// privacyKey reads the signing key, creating it the first time it is needed.
+func privacyKey() ([]byte, error) {
+	privacyLock.Lock()
+	defer privacyLock.Unlock()
+	if privacyKeyVal != nil {
+		return privacyKeyVal, nil
+	}
+	key, err := os.ReadFile(privacyKeyPath())
+	if errors.Is(err, os.ErrNotExist) {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(privacyKeyPath(), key, 0o600)
+	}
+	if err != nil {
+		return nil, err
+	} else if len(key) < 32 {
+		return nil, fmt.Errorf("%v is too short", privacyKeyPath())
+	}
+	privacyKeyVal = key
+	return key, nil
+}
+
+// allowLink records that a link of a kind is mailed to an address, unless
+// one was sent less than privacyLinkInterval ago.
+func allowLink(kind, email string) bool {
+	key := kind + "\n" + strings.ToLower(email)
+	privacyLock.Lock()
+	defer privacyLock.Unlock()
+	if time.Since(linksSent[key]) < privacyLinkInterval {
+		return false
+	}
+	linksSent[key] = time.Now()
+	return true
+}
+
+func tokenSignature(key []byte, email string, expires int64) []byte {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "privacy\n%v\n%v", strings.ToLower(email), expires)
+	return mac.Sum(nil)
+}
+
+// newPrivacyToken returns a token for an email address that expires after
+// privacyLinkLifetime, in the form email.expiry.signature.
+func newPrivacyToken(email string) (string, error) {
+	key, err := privacyKey()
+	if err != nil {
+		return "", err
+	}
+	expires := time.Now().Add(privacyLinkLifetime).Unix()
+	encoding := base64.RawURLEncoding
+	return encoding.EncodeToString([]byte(email)) + "." + strconv.FormatInt(expires, 10) + "." +
+		encoding.EncodeToString(tokenSignature(key, email, expires)), nil
+}
+
+var errPrivacyToken = errors.New("invalid or expired link")
+
+// checkPrivacyToken returns the email address a token was issued for.
+func checkPrivacyToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errPrivacyToken
+	}
+	encoding := base64.RawURLEncoding
+	email, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errPrivacyToken
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", errPrivacyToken
+	}
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errPrivacyToken
+	}
+	key, err := privacyKey()
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal(signature, tokenSignature(key, string(email), expires)) {
+		return "", errPrivacyToken
+	}
+	return string(email), nil
+}
+
+// personalData is everything kept about one email address, which is what a
+// guest downloads.
+type personalData struct {
+	Email       string        `json:"email"`
+	Exported    time.Time     `json:"exported"`
+	Responses   []*Rsvp       `json:"responses"`
+	Invitations []*Invitation `json:"invitations"`
+	Audit       []auditEntry  `json:"audit"`
+	QueuedMail  []mailMessage `json:"queuedMail"`
+}
+
+// ownsResponse reports whether a response is the guest's own. The answers
+// for a household all carry the email address of whoever gave them, so a
+// household answer belongs to the guest only if it is for the member the
+// guest was invited as.
+func ownsResponse(rsvp *Rsvp, email string) bool {
+	if !strings.EqualFold(rsvp.Email, email) {
+		return false
+	}
+	if rsvp.Household == "" {
+		return true
+	}
+	inv := findMember(rsvp.Household, rsvp.Name)
+	return inv != nil && strings.EqualFold(inv.Email, email)
+}
+
+// collectPersonalData gathers the data for an email address. The caller must
+// hold the store.
+func collectPersonalData(email string) (personalData, error) {
+	data := personalData{
+		Email: email, Exported: time.Now().UTC(),
+		Responses: []*Rsvp{}, Invitations: []*Invitation{}, QueuedMail: queuedMail(email),
+	}
+	for _, rsvp := range responses {
+		if ownsResponse(rsvp, email) {
+			data.Responses = append(data.Responses, rsvp)
+		}
+	}
+	for _, inv := range invitations {
+		if strings.EqualFold(inv.Email, email) {
+			data.Invitations = append(data.Invitations, inv)
+		}
+	}
+	entries, err := readAudit()
+	if err != nil {
+		return data, err
+	}
+	data.Audit = []auditEntry{}
+	for _, entry := range entries {
+		if auditMentions(entry, email) {
+			data.Audit = append(data.Audit, entry)
+		}
+	}
+	return data, nil
+}
+
+// erasePersonalData removes the responses and invitations for an email
+// address, erases it from the audit log and drops the mail queued for it.
+// Household members the guest answered for keep their answers. Removing a
+// response can free a place, so the waitlist is promoted. The caller must
+// hold the store.
+func erasePersonalData(email string) error {
+	before := captureStore()
+	keptResponses := []*Rsvp{}
+	for _, rsvp := range responses {
+		if ownsResponse(rsvp, email) {
+			continue
+		}
+		if strings.EqualFold(rsvp.Email, email) {
+			// A member the guest answered for keeps their answer, but not
+			// the guest's contact details.
+			rsvp.Email, rsvp.Phone = "", ""
+			if inv := findMember(rsvp.Household, rsvp.Name); inv != nil {
+				rsvp.Phone = inv.Phone
+			}
+		}
+		keptResponses = append(keptResponses, rsvp)
+	}
+	keptInvitations := []*Invitation{}
+	for _, inv := range invitations {
+		if !strings.EqualFold(inv.Email, email) {
+			keptInvitations = append(keptInvitations, inv)
+		}
+	}
+	responses, invitations = keptResponses, keptInvitations
+	promotions := promoteWaitlist()
+	if err := saveChange(before); err != nil {
+		return err
+	}
+	removeMail(email)
+	err := eraseAudit(map[string]bool{strings.ToLower(email): true}, auditSource{Actor: "guest:" + erased})
+	announcePromotions(promotions)
+	return err
+}
+
+type privacyData struct {
+	Step         string
+	Email, Token string
+	Responses    int
+	Invitations  int
+	Changes      int
+	Errors       []string
+}
+
+// privacyHandler asks for an email address and mails a link to it. The page
+// says the same whether or not anything is kept for the address, so it
+// cannot be used to find out who is invited.
+func privacyHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method == http.MethodGet {
+		renderTemplate(writer, request, http.StatusOK, "privacy", privacyData{Step: "request"})
+		return
+	}
+	email := strings.TrimSpace(request.FormValue("email"))
+	if email == "" {
+		renderTemplate(writer, request, http.StatusUnprocessableEntity, "privacy", privacyData{
+			Step: "request", Errors: []string{localizerFor(request).T("error.email")},
+		})
+		return
+	}
+	lockStore()
+	defer unlockStore()
+	data, err := collectPersonalData(email)
+	if err != nil {
+		loggerFor(request).Error("failed to collect personal data", "error", err)
+		showError(writer, request, http.StatusInternalServerError, "error.privacy")
+		return
+	}
+	known := len(data.Responses) > 0 || len(data.Invitations) > 0 || len(data.Audit) > 0
+	if known && allowLink("privacy", email) {
+		token, err := newPrivacyToken(email)
+		if err != nil {
+			loggerFor(request).Error("failed to sign privacy link", "error", err)
+			showError(writer, request, http.StatusInternalServerError, "error.privacy")
+			return
+		}
+		sendPrivacyLink(email, config.BaseURL+"/privacy/manage?token="+url.QueryEscape(token))
+	}
+	renderTemplate(writer, request, http.StatusOK, "privacy", privacyData{Step: "sent", Email: email})
+}
+
+// privacyRequest checks the token of a request from a mailed link, showing
+// an error page if it is not valid.
+func privacyRequest(writer http.ResponseWriter, request *http.Request) (string, bool) {
+	email, err := checkPrivacyToken(request.FormValue("token"))
+	if errors.Is(err, errPrivacyToken) {
+		showError(writer, request, http.StatusForbidden, "error.privacy-link")
+		return "", false
+	} else if err != nil {
+		loggerFor(request).Error("failed to check privacy link", "error", err)
+		showError(writer, request, http.StatusInternalServerError, "error.privacy")
+		return "", false
+	}
+	return email, true
+}
+
+// privacyManageHandler is where a mailed link leads: it sums up what is kept
+// for the address and offers the download and deletion.
+func privacyManageHandler(writer http.ResponseWriter, request *http.Request) {
+	if email, ok := privacyRequest(writer, request); ok {
+		showPrivacyManage(writer, request, email, http.StatusOK, nil)
+	}
+}
+
+func showPrivacyManage(writer http.ResponseWriter, request *http.Request, email string, status int, errors []string) {
+	lockStore()
+	data, err := collectPersonalData(email)
+	unlockStore()
+	if err != nil {
+		loggerFor(request).Error("failed to collect personal data", "error", err)
+		showError(writer, request, http.StatusInternalServerError, "error.privacy")
+		return
+	}
+	renderTemplate(writer, request, status, "privacy", privacyData{
+		Step: "manage", Email: email, Token: request.FormValue("token"),
+		Responses: len(data.Responses), Invitations: len(data.Invitations), Changes: len(data.Audit),
+		Errors: errors,
+	})
+}
+
+func privacyExportHandler(writer http.ResponseWriter, request *http.Request) {
+	email, ok := privacyRequest(writer, request)
+	if !ok {
+		return
+	}
+	lockStore()
+	data, err := collectPersonalData(email)
+	unlockStore()
+	if err != nil {
+		loggerFor(request).Error("failed to collect personal data", "error", err)
+		showError(writer, request, http.StatusInternalServerError, "error.privacy")
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Content-Disposition", `attachment; filename="my-party-data.json"`)
+	writer.Header().Set("Cache-Control", "no-store")
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(data)
+}
+
+func privacyDeleteHandler(writer http.ResponseWriter, request *http.Request) {
+	email, ok := privacyRequest(writer, request)
+	if !ok {
+		return
+	}
+	if request.FormValue("confirm") != "true" {
+		showPrivacyManage(writer, request, email, http.StatusUnprocessableEntity,
+			[]string{localizerFor(request).T("error.privacy-confirm")})
+		return
+	}
+	lockStore()
+	defer unlockStore()
+	if err := erasePersonalData(email); err != nil {
+		loggerFor(request).Error("failed to erase personal data", "error", err)
+		showError(writer, request, http.StatusInternalServerError, "error.privacy")
+		return
+	}
+	loggerFor(request).Info("personal data erased at a guest's request")
+	renderTemplate(writer, request, http.StatusOK, "privacy", privacyData{Step: "deleted"})
+}
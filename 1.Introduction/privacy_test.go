@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func usePrivacyKey(t *testing.T) []byte {
+	t.Helper()
+	config.DataDir = t.TempDir()
+	privacyKeyVal = nil
+	key, err := privacyKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestPrivacyToken(t *testing.T) {
+	usePrivacyKey(t)
+	token, err := newPrivacyToken("Ann@Example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	email, err := checkPrivacyToken(token)
+	if err != nil || email != "Ann@Example.org" {
+		t.Fatalf("checkPrivacyToken = %q, %v", email, err)
+	}
+}
+
+func TestPrivacyTokenRejected(t *testing.T) {
+	key := usePrivacyKey(t)
+	encoding := base64.RawURLEncoding
+	token, err := newPrivacyToken("ann@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	expired := time.Now().Add(-time.Minute).Unix()
+	tests := map[string]string{
+		"empty":          "",
+		"two parts":      parts[0] + "." + parts[1],
+		"other email":    encoding.EncodeToString([]byte("bob@example.org")) + "." + parts[1] + "." + parts[2],
+		"later expiry":   parts[0] + "." + strconv.FormatInt(time.Now().Add(48*time.Hour).Unix(), 10) + "." + parts[2],
+		"bad signature":  parts[0] + "." + parts[1] + "." + encoding.EncodeToString([]byte("not the signature")),
+		"bad encoding":   "!!!." + parts[1] + "." + parts[2],
+		"bad expiry":     parts[0] + ".soon." + parts[2],
+		"expired":        parts[0] + "." + strconv.FormatInt(expired, 10) + "." + encoding.EncodeToString(tokenSignature(key, "ann@example.org", expired)),
+		"extra part":     token + ".x",
+		"signature only": parts[2],
+	}
+	for name, token := range tests {
+		if email, err := checkPrivacyToken(token); !errors.Is(err, errPrivacyToken) {
+			t.Errorf("%v: checkPrivacyToken = %q, %v, want errPrivacyToken", name, email, err)
+		}
+	}
+}
+
+func TestPrivacyTokenOtherKey(t *testing.T) {
+	usePrivacyKey(t)
+	token, err := newPrivacyToken("ann@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	usePrivacyKey(t)
+	if _, err := checkPrivacyToken(token); !errors.Is(err, errPrivacyToken) {
+		t.Errorf("a token signed with another key was accepted: %v", err)
+	}
+}
+
+// useHousehold stores a household in which Ann answered for Bob, who has no
+// email address of his own.
+func useHousehold(t *testing.T) {
+	t.Helper()
+	config.DataDir = t.TempDir()
+	invitations = []*Invitation{
+		{Name: "Ann", Email: "ann@example.org", Phone: "555 0100", Group: "Smiths"},
+		{Name: "Bob", Group: "Smiths"},
+	}
+	responses = []*Rsvp{
+		{Name: "Ann", Email: "ann@example.org", Phone: "555 0100", Household: "Smiths", WillAttend: true},
+		{Name: "Bob", Email: "ann@example.org", Phone: "555 0100", Household: "Smiths", WillAttend: true},
+	}
+	t.Cleanup(func() { responses, invitations = nil, nil })
+}
+
+func TestCollectPersonalDataHousehold(t *testing.T) {
+	useHousehold(t)
+	data, err := collectPersonalData("ann@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Responses) != 1 || data.Responses[0].Name != "Ann" {
+		t.Errorf("export has responses %+v, want only Ann's", data.Responses)
+	}
+}
+
+func TestErasePersonalDataHousehold(t *testing.T) {
+	useHousehold(t)
+	if err := erasePersonalData("ann@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 1 || responses[0].Name != "Bob" || !responses[0].WillAttend {
+		t.Fatalf("responses after erasing are %+v, want Bob's answer", responses)
+	}
+	if bob := responses[0]; bob.Email != "" || bob.Phone != "" {
+		t.Errorf("Bob kept Ann's contact details: %+v", bob)
+	}
+	if len(invitations) != 1 || invitations[0].Name != "Bob" {
+		t.Errorf("invitations after erasing are %+v", invitations)
+	}
+}
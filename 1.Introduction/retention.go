@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Once the retention period after the event is over, the names, email
+// addresses and phone numbers in responses and invitations are replaced with
+// pseudonyms such as "Guest 3f9a0c1b7d2e4a65" and
+// guest-3f9a0c1b7d2e4a65@anonymized.invalid. The same guest gets the same
+// pseudonym everywhere and in every run, so invitations still match their
+// responses and households stay together, which keeps the attendance numbers
+// on the dashboard and in the stats command as they were.
+
+// anonymousDomain is a reserved domain, so mail is never sent to a pseudonym.
+const anonymousDomain = "@anonymized.invalid"
+
+// retentionInterval is how often the retention worker checks the store.
+const retentionInterval = time.Hour
+
+// retentionDeadline returns when personal data is to be anonymized, or the
+// zero time if it is kept.
+func (event EventConfig) retentionDeadline() time.Time {
+	if event.RetentionDays == 0 || event.When().IsZero() {
+		return time.Time{}
+	}
+	return event.When().AddDate(0, 0, event.RetentionDays)
+}
+
+func isAnonymous(email string) bool {
+	return strings.HasSuffix(email, anonymousDomain)
+}
+
+// A pseudonymizer derives pseudonyms from an HMAC of the email address,
+// household or household member keyed with the privacy key, so the same guest
+// gets the same pseudonym in every run of the retention worker, while the
+// pseudonym cannot be traced back to the guest without the key. 64 bits keep
+// two guests from sharing one.
+type pseudonymizer struct {
+	key []byte
+}
+
+func newPseudonymizer() (*pseudonymizer, error) {
+	key, err := privacyKey()
+	if err != nil {
+		return nil, err
+	}
+	return &pseudonymizer{key: key}, nil
+}
+
+func (p *pseudonymizer) pseudonym(kind, value string) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte("pseudonym\n" + kind + "\n" + value))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// member is the pseudonym of a household member, or of an invited guest
+// without an email address.
+func (p *pseudonymizer) member(name, household string) string {
+	return p.pseudonym("member", strings.ToLower(household)+"\n"+name)
+}
+
+func (p *pseudonymizer) email(email, name, household string) string {
+	if email == "" {
+		return "guest-" + p.member(name, household) + anonymousDomain
+	}
+	return "guest-" + p.pseudonym("email", strings.ToLower(email)) + anonymousDomain
+}
+
+func (p *pseudonymizer) household(household string) string {
+	if household == "" {
+		return ""
+	}
+	return "Household " + p.pseudonym("household", strings.ToLower(household))
+}
+
+// name gives a household member or a guest without an email address a
+// pseudonym of their own, and a guest who answered for themselves the one
+// from their email address.
+func (p *pseudonymizer) name(name, email, household string) string {
+	if household != "" || email == "" {
+		return "Guest " + p.member(name, household)
+	}
+	return "Guest " + p.pseudonym("email", strings.ToLower(email))
+}
+
+// anonymizeStore replaces the personal data in responses and invitations that
+// have not been anonymized yet, erases the guests from the audit log and
+// drops mail queued for them. It returns how many responses and invitations
+// it changed. The caller must hold the store.
+func anonymizeStore() (int, int, error) {
+	p, err := newPseudonymizer()
+	if err != nil {
+		return 0, 0, err
+	}
+	before := captureStore()
+	emails := map[string]bool{}
+	changedResponses, changedInvitations := 0, 0
+	for _, rsvp := range responses {
+		if isAnonymous(rsvp.Email) {
+			continue
+		}
+		if rsvp.Email != "" {
+			emails[strings.ToLower(rsvp.Email)] = true
+		}
+		rsvp.Name, rsvp.Email, rsvp.Household = p.name(rsvp.Name, rsvp.Email, rsvp.Household),
+			p.email(rsvp.Email, rsvp.Name, rsvp.Household), p.household(rsvp.Household)
+		rsvp.Phone, rsvp.UserAgent = "", ""
+		changedResponses++
+	}
+	for _, inv := range invitations {
+		if isAnonymous(inv.Email) {
+			continue
+		}
+		if inv.Email != "" {
+			emails[strings.ToLower(inv.Email)] = true
+		}
+		inv.Name, inv.Email, inv.Group = p.name(inv.Name, inv.Email, inv.Group),
+			p.email(inv.Email, inv.Name, inv.Group), p.household(inv.Group)
+		inv.Phone = ""
+		changedInvitations++
+	}
+	if changedResponses+changedInvitations == 0 {
+		return 0, 0, nil
+	}
+	if err := saveChange(before); err != nil {
+		return 0, 0, err
+	}
+	for email := range emails {
+		removeMail(email)
+	}
+	return changedResponses, changedInvitations, eraseAudit(emails, systemSource)
+}
+
+// applyRetention anonymizes the store if the retention period is over.
+func applyRetention() {
+	deadline := config.Event.retentionDeadline()
+	if deadline.IsZero() || time.Now().Before(deadline) {
+		return
+	}
+	lockStore()
+	defer unlockStore()
+	if storeLoadError() != nil {
+		return
+	}
+	changedResponses, changedInvitations, err := anonymizeStore()
+	if err != nil {
+		slog.Error("failed to anonymize personal data", "error", err)
+	} else if changedResponses > 0 || changedInvitations > 0 {
+		slog.Info("personal data anonymized after the retention period",
+			"responses", changedResponses, "invitations", changedInvitations, "deadline", deadline)
+	}
+}
+
+// retentionWorker applies the retention policy at startup and then every
+// retentionInterval, which also catches answers given after the deadline.
+func retentionWorker() {
+	for {
+		applyRetention()
+		time.Sleep(retentionInterval)
+	}
+}
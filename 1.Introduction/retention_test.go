@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestAnonymizeStoreKeepsPseudonymsAcrossRuns(t *testing.T) {
+	usePrivacyKey(t)
+	defer func() { responses, invitations = nil, nil }()
+	invitations = []*Invitation{
+		{Name: "Ann", Email: "ann@example.org"},
+		{Name: "Bob", Email: "bob@example.org"},
+		{Name: "Cy"},
+	}
+	responses = []*Rsvp{{Name: "Ann", Email: "ann@example.org", WillAttend: true}}
+	if changed, _, err := anonymizeStore(); err != nil || changed != 1 {
+		t.Fatalf("first run changed %v responses, error %v", changed, err)
+	}
+
+	responses = append(responses, &Rsvp{Name: "Bob", Email: "Bob@example.org", WillAttend: true})
+	if changed, _, err := anonymizeStore(); err != nil || changed != 1 {
+		t.Fatalf("second run changed %v responses, error %v", changed, err)
+	}
+	for i, rsvp := range responses {
+		if inv := invitations[i]; rsvp.Email != inv.Email || rsvp.Name != inv.Name {
+			t.Errorf("response %+v does not match invitation %+v", rsvp, inv)
+		}
+	}
+	if cy := invitations[2]; !isAnonymous(cy.Email) || cy.Name == invitations[0].Name {
+		t.Errorf("invitation without email became %+v", cy)
+	}
+}
+
+func TestAnonymizeStoreSavesInvitationsWithoutEmail(t *testing.T) {
+	usePrivacyKey(t)
+	defer func() { responses, invitations = nil, nil }()
+	invitations = []*Invitation{{Name: "Cy", Phone: "555 0100"}}
+	if _, changed, err := anonymizeStore(); err != nil || changed != 1 {
+		t.Fatalf("changed %v invitations, error %v", changed, err)
+	}
+	invitations = nil
+	if err := loadStore(); err != nil {
+		t.Fatal(err)
+	}
+	if len(invitations) != 1 || !isAnonymous(invitations[0].Email) || invitations[0].Phone != "" {
+		t.Errorf("saved invitations are %+v", invitations)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// router dispatches on the exact path and the method, except for prefix
+// routes, which match everything below them. Unknown paths get a styled 404
+// page and known paths with the wrong method a 405 with an Allow header.
+// HEAD is answered by GET handlers, since net/http drops the body for HEAD,
+// and OPTIONS lists the allowed methods.
+type router struct {
+	routes   map[string]map[string]http.Handler
+	prefixes []string
+}
+
+func newRouter() *router {
+	return &router{routes: map[string]map[string]http.Handler{}}
+}
+
+func (r *router) handle(path string, handler http.Handler, methods ...string) {
+	if r.routes[path] == nil {
+		r.routes[path] = map[string]http.Handler{}
+	}
+	for _, method := range methods {
+		r.routes[path][method] = handler
+		if method == http.MethodGet {
+			r.routes[path][http.MethodHead] = handler
+		}
+	}
+}
+
+func (r *router) handleFunc(path string, handler http.HandlerFunc, methods ...string) {
+	r.handle(path, handler, methods...)
+}
+
+// handlePrefix registers a handler for every path that starts with prefix,
+// which must end in "/". Longer prefixes win over shorter ones.
+func (r *router) handlePrefix(prefix string, handler http.Handler, methods ...string) {
+	r.handle(prefix, handler, methods...)
+	r.prefixes = append(r.prefixes, prefix)
+	sort.Slice(r.prefixes, func(i, j int) bool { return len(r.prefixes[i]) > len(r.prefixes[j]) })
+}
+
+// route returns the path or prefix a request path is registered under, or
+// "" if there is none.
+func (r *router) route(path string) string {
+	if _, ok := r.routes[path]; ok {
+		return path
+	}
+	for _, prefix := range r.prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return prefix
+		}
+	}
+	return ""
+}
+
+func (r *router) match(path string) map[string]http.Handler {
+	return r.routes[r.route(path)]
+}
+
+func (r *router) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	methods := r.match(request.URL.Path)
+	if methods == nil {
+		showError(writer, request, http.StatusNotFound, "error.not-found")
+		return
+	}
+	if handler, ok := methods[request.Method]; ok {
+		handler.ServeHTTP(writer, request)
+		return
+	}
+	allowed := []string{http.MethodOptions}
+	for method := range methods {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	writer.Header().Set("Allow", strings.Join(allowed, ", "))
+	if request.Method == http.MethodOptions {
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+	showError(writer, request, http.StatusMethodNotAllowed, "error.method-not-allowed")
+}
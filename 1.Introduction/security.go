@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// securityConfig holds the security headers sent with every response. The
+// Content Security Policy may contain {nonce}, which is replaced with a value
+// that is new for each request and that templates put on their inline
+// <script> and <style> elements with the nonce function.
+type securityConfig struct {
+	CSP               string `json:"csp"`
+	CSPReportOnly     bool   `json:"cspReportOnly"`
+	FrameAncestors    string `json:"frameAncestors"`
+	ReferrerPolicy    string `json:"referrerPolicy"`
+	PermissionsPolicy string `json:"permissionsPolicy"`
+}
+
+// defaultCSP allows nothing from other sites. Images may use data: URLs,
+// which Bootstrap's stylesheet needs for its form controls.
+const defaultCSP = "default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self' 'nonce-{nonce}'; " +
+	"img-src 'self' data:; connect-src 'self'; object-src 'none'; base-uri 'none'; form-action 'self'"
+
+func defaultSecurity() securityConfig {
+	return securityConfig{
+		CSP:               defaultCSP,
+		FrameAncestors:    "'self'",
+		ReferrerPolicy:    "same-origin",
+		PermissionsPolicy: "camera=(), microphone=(), geolocation=(), payment=(), usb=()",
+	}
+}
+
+type nonceContextKey struct{}
+
+// nonceFor returns the CSP nonce for the request, or "" outside of
+// secureHeaders.
+func nonceFor(request *http.Request) string {
+	nonce, _ := request.Context().Value(nonceContextKey{}).(string)
+	return nonce
+}
+
+func newNonce() string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return base64.RawURLEncoding.EncodeToString(nonce)
+}
+
+// policy returns the Content Security Policy for a nonce. frame-ancestors is
+// added from its own setting unless the configured policy already has it.
+func (s securityConfig) policy(nonce string) string {
+	policy := strings.ReplaceAll(s.CSP, "{nonce}", nonce)
+	if s.FrameAncestors != "" && !strings.Contains(policy, "frame-ancestors") {
+		policy = strings.TrimSuffix(strings.TrimSpace(policy), ";") + "; frame-ancestors " + s.FrameAncestors
+	}
+	return policy
+}
+
+// secureHeaders sets the configured security headers and gives the request
+// a fresh CSP nonce. The theme preview is shown in a frame on the theme
+// page, so frame-ancestors must allow 'self' for it to work.
+func secureHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		security := config.Security
+		nonce := newNonce()
+		header := writer.Header()
+		if security.CSP != "" {
+			name := "Content-Security-Policy"
+			if security.CSPReportOnly {
+				name = "Content-Security-Policy-Report-Only"
+			}
+			header.Set(name, security.policy(nonce))
+		}
+		switch security.FrameAncestors {
+		case "'none'":
+			header.Set("X-Frame-Options", "DENY")
+		case "'self'":
+			header.Set("X-Frame-Options", "SAMEORIGIN")
+		}
+		header.Set("X-Content-Type-Options", "nosniff")
+		if security.ReferrerPolicy != "" {
+			header.Set("Referrer-Policy", security.ReferrerPolicy)
+		}
+		if security.PermissionsPolicy != "" {
+			header.Set("Permissions-Policy", security.PermissionsPolicy)
+		}
+		request = request.WithContext(context.WithValue(request.Context(), nonceContextKey{}, nonce))
+		next.ServeHTTP(writer, request)
+	})
+}
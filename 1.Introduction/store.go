@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// storeLock guards invitations and responses. Handlers hold it for the whole
+// request, through lockStore, so a page never sees a half-applied change.
+var storeLock sync.Mutex
+
+// The command line tools change the store file while the server may be
+// running. Both sides hold a lock on rsvps.lock while they use the store, and
+// lockStore reloads the file when it has changed since it was last read or
+// written, so neither side overwrites the other's changes.
+var unlockStoreFile = func() {}
+
+type fileStamp struct {
+	modTime, size int64
+}
+
+var loadedStamp fileStamp
+
+func storeStamp() fileStamp {
+	info, err := os.Stat(storePath())
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: info.ModTime().UnixNano(), size: info.Size()}
+}
+
+func lockPath() string {
+	return filepath.Join(config.DataDir, "rsvps.lock")
+}
+
+// lockStore takes storeLock and the file lock and brings the store up to
+// date with the file. A store that cannot be reloaded keeps its old contents
+// and refuses to save until the file can be read again.
+func lockStore() {
+	storeLock.Lock()
+	unlock, err := lockFile(lockPath())
+	if err != nil {
+		slog.Warn("failed to lock the store file", "path", lockPath(), "error", err)
+		unlock = func() {}
+	}
+	unlockStoreFile = unlock
+	if storeStamp() != loadedStamp {
+		err := loadStore()
+		setStoreLoadError(err)
+		if err != nil {
+			slog.Error("failed to reload RSVPs, changes will not be saved", "path", storePath(), "error", err)
+		} else {
+			slog.Debug("reloaded RSVPs", "path", storePath())
+		}
+	}
+}
+
+func unlockStore() {
+	unlockStoreFile()
+	unlockStoreFile = func() {}
+	storeLock.Unlock()
+}
+
+type storeData struct {
+	Invitations []*Invitation
+	Responses   []*Rsvp
+	Theme       *Theme
+}
+
+// UnmarshalJSON reads responses saved before they had Created and Updated
+// times, when the only time kept was when the guest last Responded.
+func (rsvp *Rsvp) UnmarshalJSON(data []byte) error {
+	type plainRsvp Rsvp
+	saved := struct {
+		*plainRsvp
+		Responded time.Time
+	}{plainRsvp: (*plainRsvp)(rsvp)}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	if rsvp.Updated.IsZero() {
+		rsvp.Created, rsvp.Updated = saved.Responded, saved.Responded
+	}
+	return nil
+}
+
+// storeLoadError is the error from the last time the store existed but could
+// not be read, at startup or when it was reloaded. Saving is refused until it
+// is cleared, since it would replace the guests' answers with an empty list.
+// It has a lock of its own so the readiness check can read it while
+// lockStore waits for the file lock.
+var (
+	storeLoadErrorLock sync.Mutex
+	storeLoadErrorVal  error
+)
+
+func storeLoadError() error {
+	storeLoadErrorLock.Lock()
+	defer storeLoadErrorLock.Unlock()
+	return storeLoadErrorVal
+}
+
+func setStoreLoadError(err error) {
+	storeLoadErrorLock.Lock()
+	defer storeLoadErrorLock.Unlock()
+	storeLoadErrorVal = err
+}
+
+func storePath() string {
+	return filepath.Join(config.DataDir, "rsvps.json")
+}
+
+func loadStore() error {
+	loadedStamp = storeStamp()
+	file, err := os.Open(storePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	data := storeData{}
+	if err := json.NewDecoder(file).Decode(&data); err != nil {
+		return err
+	}
+	invitations = append(invitations[:0], data.Invitations...)
+	responses = append(responses[:0], data.Responses...)
+	if data.Theme != nil {
+		themeLock.Lock()
+		eventTheme = *data.Theme
+		themeLock.Unlock()
+	}
+	return nil
+}
+
+// saveStore writes the invitations, responses and theme to a temporary file and
+// renames it over the old one, so a crash never leaves a partial file behind.
+// The caller must hold the store through lockStore.
+func saveStore() error {
+	if err := storeLoadError(); err != nil {
+		return fmt.Errorf("not saving, the store could not be loaded: %w", err)
+	}
+	start := time.Now()
+	err := writeStore()
+	storeWrites.observe(time.Since(start).Seconds())
+	if err != nil {
+		storeWriteErrors.inc()
+	}
+	return err
+}
+
+// A storeState is a copy of the responses and invitations taken before a
+// change. When the change cannot be saved, restore puts them back, so the
+// change is not kept in memory and written out by a later, unrelated save.
+// Handlers change responses in place, so the values are copied as well as
+// the slices.
+type storeState struct {
+	responses   []*Rsvp
+	answers     []Rsvp
+	invitations []*Invitation
+	invited     []Invitation
+}
+
+// captureStore copies the store before a change. The caller must hold the
+// store.
+func captureStore() storeState {
+	state := storeState{
+		responses:   append([]*Rsvp{}, responses...),
+		invitations: append([]*Invitation{}, invitations...),
+	}
+	for _, rsvp := range responses {
+		state.answers = append(state.answers, *rsvp)
+	}
+	for _, inv := range invitations {
+		state.invited = append(state.invited, *inv)
+	}
+	return state
+}
+
+func (state storeState) restore() {
+	for i, rsvp := range state.responses {
+		*rsvp = state.answers[i]
+	}
+	for i, inv := range state.invitations {
+		*inv = state.invited[i]
+	}
+	responses, invitations = state.responses, state.invitations
+}
+
+// saveChange saves the changes made since state was captured, or undoes them
+// if the store cannot be saved.
+func saveChange(state storeState) error {
+	err := saveStore()
+	if err != nil {
+		state.restore()
+	}
+	return err
+}
+
+func writeStore() error {
+	file, err := os.CreateTemp(config.DataDir, "rsvps-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	theme := currentTheme()
+	if err := encoder.Encode(storeData{Invitations: invitations, Responses: responses, Theme: &theme}); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), storePath()); err != nil {
+		return err
+	}
+	loadedStamp = storeStamp()
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package main
+
+// lockFile does nothing where flock is not available. The server and the
+// command line tools should not change the store at the same time there.
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
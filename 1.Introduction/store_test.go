@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSaveChangeUndoesFailedSave(t *testing.T) {
+	ann := &Rsvp{Name: "Ann", Email: "ann@example.org", WillAttend: true}
+	responses = []*Rsvp{ann}
+	invitations = []*Invitation{{Name: "Ann", Email: "ann@example.org"}}
+	setStoreLoadError(errors.New("broken store"))
+	defer func() {
+		setStoreLoadError(nil)
+		responses, invitations = nil, nil
+	}()
+
+	before := captureStore()
+	ann.WillAttend = false
+	responses = append(responses, &Rsvp{Name: "Bob", Email: "bob@example.org"})
+	invitations = nil
+	if err := saveChange(before); err == nil {
+		t.Fatal("saveChange succeeded with a broken store")
+	}
+	if len(responses) != 1 || responses[0] != ann || !ann.WillAttend {
+		t.Errorf("responses were not restored: %+v", responses)
+	}
+	if len(invitations) != 1 || invitations[0].Name != "Ann" {
+		t.Errorf("invitations were not restored: %+v", invitations)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// templates is replaced as a whole when templates are reloaded in dev mode,
+// so a request always renders with a consistent set.
+var templates = make(map[string]*template.Template, len(templateNames))
+var templateError error
+var templatesLock sync.RWMutex
+
+func setTemplates(parsed map[string]*template.Template, err error) {
+	templatesLock.Lock()
+	defer templatesLock.Unlock()
+	if err == nil {
+		templates = parsed
+	}
+	templateError = err
+}
+
+// executePage runs a template into a buffer. Templates are cloned so that
+// functions which depend on the request, such as theme, can be bound to it;
+// the parsed originals are never executed themselves.
+func executePage(request *http.Request, name string, data interface{}) ([]byte, error) {
+	templatesLock.RLock()
+	t := templates[name]
+	templatesLock.RUnlock()
+	if t == nil {
+		return nil, fmt.Errorf("no template named %q", name)
+	}
+	t, err := t.Clone()
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	err = t.Funcs(requestFuncs(request)).Execute(&buffer, data)
+	return buffer.Bytes(), err
+}
+
+// requestFuncs replaces the placeholders in templateFuncs with functions
+// that answer for the current request.
+func requestFuncs(request *http.Request) template.FuncMap {
+	loc := localizerFor(request)
+	return template.FuncMap{
+		"theme":      func() Theme { return themeFor(request) },
+		"lang":       func() string { return loc.Lang },
+		"t":          loc.T,
+		"tn":         loc.N,
+		"pattern":    loc.Pattern,
+		"date":       loc.Date,
+		"currentURL": func() string { return request.URL.RequestURI() },
+		"nonce":      func() string { return nonceFor(request) },
+	}
+}
+
+// renderTemplate executes a template into a buffer before anything is sent,
+// so a failing template produces an error page instead of a half-written
+// page with a 200 status.
+func renderTemplate(writer http.ResponseWriter, request *http.Request, status int, name string, data interface{}) {
+	templatesLock.RLock()
+	err := templateError
+	templatesLock.RUnlock()
+	if err != nil && config.Dev {
+		showTemplateError(writer, request, err)
+		return
+	} else if err != nil {
+		showError(writer, request, http.StatusServiceUnavailable, "error.unavailable")
+		return
+	}
+	body, err := executePage(request, name, data)
+	if err != nil {
+		loggerFor(request).Error("failed to render template", "template", name, "error", err)
+		renderErrors.inc(name)
+		showError(writer, request, http.StatusInternalServerError, "error.render")
+		return
+	}
+	writeHTML(writer, status, body)
+}
+
+func writeHTML(writer http.ResponseWriter, status int, body []byte) {
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	writer.WriteHeader(status)
+	writer.Write(body)
+}
+
+type errorData struct {
+	Status         int
+	Title, Message string
+}
+
+// showError renders error.html with the given status and the message with
+// the given catalog key. If that template fails too, a plain text response is
+// sent so the client still gets the status.
+func showError(writer http.ResponseWriter, request *http.Request, status int, messageKey string) {
+	loc := localizerFor(request)
+	title := loc.T(fmt.Sprintf("status.%v", status))
+	if strings.HasPrefix(title, "status.") {
+		title = http.StatusText(status)
+	}
+	data := errorData{Status: status, Title: title, Message: loc.T(messageKey)}
+	body, err := executePage(request, "error", data)
+	if err != nil {
+		http.Error(writer, data.Message, status)
+		return
+	}
+	writeHTML(writer, status, body)
+}
+
+// watchTemplates polls the template directory and re-parses every template
+// when a file is added, removed or modified. A template that fails to parse
+// leaves the error page in place until it is fixed.
+func watchTemplates(dir string) {
+	slog.Info("watching for template changes", "dir", dir)
+	last := templateSignature(dir)
+	for range time.Tick(time.Second) {
+		current := templateSignature(dir)
+		if current == last {
+			continue
+		}
+		last = current
+		parsed, err := parseTemplates()
+		setTemplates(parsed, err)
+		if err != nil {
+			slog.Error("template error", "error", err)
+		} else {
+			slog.Info("reloaded templates")
+		}
+	}
+}
+
+func templateSignature(dir string) string {
+	var signature strings.Builder
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.html"))
+	for _, path := range matches {
+		if info, err := os.Stat(path); err == nil {
+			fmt.Fprintf(&signature, "%v %v %v\n", path, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return signature.String()
+}
+
+type sourceLine struct {
+	Number int
+	Text   string
+	Failed bool
+}
+
+type templateErrorData struct {
+	Error, File string
+	Nonce       string
+	Line        int
+	Source      []sourceLine
+}
+
+var templateErrorLocation = regexp.MustCompile(`template: ([^:]+\.html):(\d+):`)
+
+// showTemplateError explains a template parse error, including the lines
+// around the failure, instead of panicking. It is only reached in dev mode.
+func showTemplateError(writer http.ResponseWriter, request *http.Request, err error) {
+	data := templateErrorData{Error: err.Error(), Nonce: nonceFor(request)}
+	if match := templateErrorLocation.FindStringSubmatch(data.Error); match != nil {
+		data.File = match[1]
+		data.Line, _ = strconv.Atoi(match[2])
+		data.Source = sourceAround(data.File, data.Line)
+	}
+	var buffer bytes.Buffer
+	templateErrorPage.Execute(&buffer, data)
+	writeHTML(writer, http.StatusInternalServerError, buffer.Bytes())
+}
+
+func sourceAround(file string, line int) []sourceLine {
+	source, err := templateFS().Open(file)
+	if err != nil {
+		return nil
+	}
+	defer source.Close()
+	lines := []sourceLine{}
+	scanner := bufio.NewScanner(source)
+	for number := 1; scanner.Scan(); number++ {
+		if number >= line-3 && number <= line+3 {
+			lines = append(lines, sourceLine{Number: number, Text: scanner.Text(), Failed: number == line})
+		}
+	}
+	return lines
+}
+
+// templateErrorPage does not use layout.html, which may be the template that
+// failed to parse.
+var templateErrorPage = template.Must(template.New("templateError").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="UTF-8">
+  <title>Template error</title>
+  <style nonce="{{ .Nonce }}">
+    body { font-family: sans-serif; margin: 2rem; }
+    h1 { color: #dc3545; }
+    pre { background: #f8f9fa; padding: 1rem; }
+    .message { white-space: pre-wrap; }
+    .failed { background: #f8d7da; }
+  </style>
+</head>
+<body>
+  <h1>Template error</h1>
+  <p>The templates could not be parsed. Fix the file and this page will work again
+  once the change is picked up.</p>
+  <pre class="message">{{ .Error }}</pre>
+  {{ if .Source }}
+  <h2>{{ .File }}, line {{ .Line }}</h2>
+  <pre>{{ range .Source }}<span{{ if .Failed }} class="failed"{{ end }}>{{ printf "%4d" .Number }}  {{ .Text }}</span>
+{{ end }}</pre>
+  {{ end }}
+</body>
+</html>`))
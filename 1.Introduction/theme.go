@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Theme controls how layout.html looks for the event. Colors and fonts are
+// validated when they are set and the custom CSS is sanitized, which is what
+// makes it safe for the methods below to return template.CSS.
+type Theme struct {
+	PrimaryColor, BackgroundColor, TextColor string
+	Font                                     string
+	Logo, Hero                               string
+	CustomCSS                                string
+}
+
+var themeFonts = map[string]string{
+	"system":      `system-ui, -apple-system, "Segoe UI", Roboto, "Helvetica Neue", Arial, sans-serif`,
+	"serif":       `Georgia, "Times New Roman", serif`,
+	"rounded":     `"Trebuchet MS", "Arial Rounded MT Bold", sans-serif`,
+	"monospace":   `ui-monospace, SFMono-Regular, Menlo, Consolas, monospace`,
+	"handwriting": `"Comic Sans MS", "Bradley Hand", cursive`,
+}
+
+func defaultTheme() Theme {
+	return Theme{PrimaryColor: "#0d6efd", BackgroundColor: "#ffffff", TextColor: "#212529", Font: "system"}
+}
+
+var eventTheme = defaultTheme()
+var themeDraft *Theme
+var themeLock sync.RWMutex
+
+func currentTheme() Theme {
+	themeLock.RLock()
+	defer themeLock.RUnlock()
+	return eventTheme
+}
+
+type themeContextKey struct{}
+
+// themeFor returns the draft theme for preview requests and the saved theme
+// for everything else.
+func themeFor(request *http.Request) Theme {
+	if draft, ok := request.Context().Value(themeContextKey{}).(Theme); ok {
+		return draft
+	}
+	return currentTheme()
+}
+
+func (t Theme) Variables() template.CSS {
+	return template.CSS(fmt.Sprintf(":root { --party-primary: %v; --party-background: %v; --party-text: %v; --party-font: %v; }",
+		t.PrimaryColor, t.BackgroundColor, t.TextColor, themeFonts[t.Font]))
+}
+
+func (t Theme) Stylesheet() template.CSS {
+	return template.CSS(t.CustomCSS)
+}
+
+func (t Theme) FontChoices() []string {
+	return []string{"system", "serif", "rounded", "monospace", "handwriting"}
+}
+
+func (t Theme) FontStack(name string) string {
+	return themeFonts[name]
+}
+
+var hexColor = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+const maxCustomCSS = 20000
+
+var (
+	cssComment    = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	cssURL        = regexp.MustCompile(`(?i)url\(\s*(['"]?)([^'")]*)(['"]?)\s*\)`)
+	cssDisallowed = regexp.MustCompile(`(?i)@import|@charset|@namespace|expression\s*\(|javascript:|vbscript:|behavior\s*:|-moz-binding|image-set\s*\(|src\s*\(`)
+)
+
+// sanitizeCSS removes anything from host-supplied CSS that could load
+// content from elsewhere, run script or end the style element early. Removing
+// one token can join the text around it into another, such as @imp@importort,
+// so the removal is repeated until nothing changes. It returns a description
+// of each kind of change so the host knows about it.
+func sanitizeCSS(css string) (string, []string) {
+	warnings := []string{}
+	if len(css) > maxCustomCSS {
+		css = css[:maxCustomCSS]
+		warnings = append(warnings, fmt.Sprintf("Custom CSS was cut to %v characters", maxCustomCSS))
+	}
+	removedChars, removedTokens, removedURL := false, false, false
+	for {
+		before := css
+		css = cssComment.ReplaceAllString(css, "")
+		if strings.ContainsAny(css, `<\`) {
+			css = strings.NewReplacer("<", "", `\`, "").Replace(css)
+			removedChars = true
+		}
+		if cssDisallowed.MatchString(css) {
+			css = cssDisallowed.ReplaceAllString(css, "")
+			removedTokens = true
+		}
+		css = cssURL.ReplaceAllStringFunc(css, func(match string) string {
+			target := cssURL.FindStringSubmatch(match)[2]
+			if strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//") && !strings.ContainsAny(target, "'\"") {
+				return `url("` + target + `")`
+			}
+			removedURL = true
+			return "none"
+		})
+		if css == before {
+			break
+		}
+	}
+	if removedChars {
+		warnings = append(warnings, `"<" and "\" are not allowed in custom CSS and were removed`)
+	}
+	if removedTokens {
+		warnings = append(warnings, "Imports, expressions and script URLs are not allowed in custom CSS and were removed")
+	}
+	if removedURL {
+		warnings = append(warnings, "Only images on this site, such as /theme/ uploads, can be used in url()")
+	}
+	return strings.TrimSpace(css), warnings
+}
+
+func themeDir() string {
+	return filepath.Join(config.DataDir, "theme")
+}
+
+var imageTypes = map[string]string{
+	"image/png": ".png", "image/jpeg": ".jpg", "image/gif": ".gif", "image/webp": ".webp",
+}
+
+const maxThemeImage = 2 << 20
+
+// saveThemeImage stores an uploaded image under a name derived from its
+// content, so it can be cached forever and drafts never overwrite the saved
+// theme's images.
+func saveThemeImage(request *http.Request, field string) (string, error) {
+	file, _, err := request.FormFile(field)
+	if err == http.ErrMissingFile {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxThemeImage+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxThemeImage {
+		return "", fmt.Errorf("images must be smaller than %v MB", maxThemeImage>>20)
+	}
+	ext, ok := imageTypes[http.DetectContentType(data)]
+	if !ok {
+		return "", fmt.Errorf("images must be PNG, JPEG, GIF or WebP files")
+	}
+	sum := sha256.Sum256(data)
+	name := hex.EncodeToString(sum[:8]) + ext
+	if err := os.MkdirAll(themeDir(), 0o755); err != nil {
+		return "", err
+	}
+	return name, os.WriteFile(filepath.Join(themeDir(), name), data, 0o644)
+}
+
+type themeData struct {
+	Theme
+	Saved    bool
+	Errors   []string
+	Warnings []string
+}
+
+// themeFromForm applies the submitted form to a copy of the current draft.
+func themeFromForm(request *http.Request, base Theme) (Theme, []string, []string) {
+	theme := base
+	errors := []string{}
+	for _, color := range []struct {
+		field, label string
+		target       *string
+	}{
+		{"primary", "Primary color", &theme.PrimaryColor},
+		{"background", "Background color", &theme.BackgroundColor},
+		{"text", "Text color", &theme.TextColor},
+	} {
+		if value := request.FormValue(color.field); hexColor.MatchString(value) {
+			*color.target = value
+		} else {
+			errors = append(errors, color.label+" must be a color such as #336699")
+		}
+	}
+	if _, ok := themeFonts[request.FormValue("font")]; ok {
+		theme.Font = request.FormValue("font")
+	} else {
+		errors = append(errors, "Please choose one of the listed fonts")
+	}
+	for _, image := range []struct {
+		field  string
+		target *string
+	}{{"logo", &theme.Logo}, {"hero", &theme.Hero}} {
+		if request.FormValue("remove"+image.field) == "true" {
+			*image.target = ""
+		} else if name, err := saveThemeImage(request, image.field); err != nil {
+			errors = append(errors, fmt.Sprintf("The %v image could not be used: %v", image.field, err))
+		} else if name != "" {
+			*image.target = name
+		}
+	}
+	css, warnings := sanitizeCSS(request.FormValue("css"))
+	theme.CustomCSS = css
+	return theme, errors, warnings
+}
+
+func themeHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method == http.MethodGet {
+		themeLock.Lock()
+		draft := eventTheme
+		themeDraft = &draft
+		themeLock.Unlock()
+		renderTemplate(writer, request, http.StatusOK, "theme", themeData{Theme: draft})
+	} else if request.Method == http.MethodPost {
+		themeLock.RLock()
+		base := eventTheme
+		if themeDraft != nil {
+			base = *themeDraft
+		}
+		themeLock.RUnlock()
+		theme, errors, warnings := themeFromForm(request, base)
+		data := themeData{Theme: theme, Errors: errors, Warnings: warnings}
+		if len(errors) > 0 {
+			renderTemplate(writer, request, http.StatusUnprocessableEntity, "theme", data)
+			return
+		}
+		themeLock.Lock()
+		themeDraft = &theme
+		themeLock.Unlock()
+		if request.FormValue("action") == "save" {
+			lockStore()
+			themeLock.Lock()
+			previous := eventTheme
+			eventTheme = theme
+			themeLock.Unlock()
+			err := saveStore()
+			if err != nil {
+				themeLock.Lock()
+				eventTheme = previous
+				themeLock.Unlock()
+			}
+			unlockStore()
+			if err != nil {
+				loggerFor(request).Error("failed to save theme", "error", err)
+				showError(writer, request, http.StatusInternalServerError, "error.save-theme")
+				return
+			}
+			loggerFor(request).Info("theme saved")
+			data.Saved = true
+		}
+		renderTemplate(writer, request, http.StatusOK, "theme", data)
+	}
+}
+
+// themePreviewHandler shows the welcome page with the draft theme for the
+// preview frame on the theme page.
+func themePreviewHandler(writer http.ResponseWriter, request *http.Request) {
+	themeLock.RLock()
+	draft := eventTheme
+	if themeDraft != nil {
+		draft = *themeDraft
+	}
+	themeLock.RUnlock()
+	request = request.WithContext(context.WithValue(request.Context(), themeContextKey{}, draft))
+	renderTemplate(writer, request, http.StatusOK, "welcome", config.Event)
+}
+
+var themeImageName = regexp.MustCompile(`^[0-9a-f]{16}\.(png|jpg|gif|webp)$`)
+
+func themeImageHandler(writer http.ResponseWriter, request *http.Request) {
+	name := strings.TrimPrefix(request.URL.Path, "/theme/")
+	if !themeImageName.MatchString(name) {
+		showError(writer, request, http.StatusNotFound, "error.no-image")
+		return
+	}
+	writer.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeFile(writer, request, filepath.Join(themeDir(), name))
+}
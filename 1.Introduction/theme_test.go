@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeCSS(t *testing.T) {
+	tests := []struct {
+		name, css, want string
+		warnings        int
+	}{
+		{"plain rules are kept", "h1 { color: red; }", "h1 { color: red; }", 0},
+		{"import is removed", `@import "https://evil.example/x.css"; h1 {}`, `"https://evil.example/x.css"; h1 {}`, 1},
+		{"nested import", "@imp@importort url(https://evil.example/x.css);", "none;", 2},
+		{"doubly nested import", "@im@imp@importortport 'x';", "'x';", 1},
+		{"comment-split import", "@imp/**/ort 'x';", "'x';", 1},
+		{"comment-split comment", "/*/**/*/@import 'x';", "*/ 'x';", 1},
+		{"backslash-split import", `@imp\ort 'x';`, "'x';", 2},
+		{"nested expression", "width: expreexpression(ssion(alert(1))", "width: alert(1))", 1},
+		{"nested script URL", "a { background: url(javajavascript:script:alert(1)) }", "a { background: none) }", 2},
+		{"closing style tag", "</style><script>alert(1)</script>", "/style>script>alert(1)/script>", 1},
+		{"local image is kept", "body { background: url( '/theme/hero.png' ) }", `body { background: url("/theme/hero.png") }`, 0},
+		{"protocol-relative image", "body { background: url(//evil.example/x.png) }", "body { background: none }", 1},
+		{"remote image", `body { background: url("https://evil.example/x.png") }`, "body { background: none }", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, warnings := sanitizeCSS(test.css)
+			if got != test.want {
+				t.Errorf("sanitizeCSS(%q) = %q, want %q", test.css, got, test.want)
+			}
+			if len(warnings) != test.warnings {
+				t.Errorf("sanitizeCSS(%q) warned %q, want %v warnings", test.css, warnings, test.warnings)
+			}
+			if again, _ := sanitizeCSS(got); again != got {
+				t.Errorf("sanitizeCSS(%q) is not stable: %q", got, again)
+			}
+			if cssDisallowed.MatchString(got) || strings.ContainsAny(got, `<\`) {
+				t.Errorf("sanitizeCSS(%q) left a disallowed token in %q", test.css, got)
+			}
+		})
+	}
+}
+
+func TestSanitizeCSSLength(t *testing.T) {
+	got, warnings := sanitizeCSS(strings.Repeat("a", maxCustomCSS+10))
+	if len(got) != maxCustomCSS || len(warnings) != 1 {
+		t.Errorf("long CSS gave %v characters and warnings %q", len(got), warnings)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// HTTPS is used when a certificate and key are configured, or when
+// SelfSigned asks for a certificate to be generated for local testing.
+// RedirectAddr optionally runs a plain HTTP listener that sends every
+// request to the HTTPS site.
+type tlsConfig struct {
+	Cert         string `json:"cert"`
+	Key          string `json:"key"`
+	SelfSigned   bool   `json:"selfSigned"`
+	RedirectAddr string `json:"redirectAddr"`
+	// HSTSMaxAge is how many seconds browsers should only use HTTPS for the
+	// site. It is not sent with self-signed certificates, which would lock
+	// browsers out of localhost. Zero disables the header.
+	HSTSMaxAge int `json:"hstsMaxAge"`
+}
+
+func (t tlsConfig) Enabled() bool {
+	return t.SelfSigned || t.Cert != ""
+}
+
+// certFiles returns the certificate and key to serve, which for a
+// self-signed certificate live in the data directory.
+func (t tlsConfig) certFiles() (string, string) {
+	if t.SelfSigned {
+		dir := filepath.Join(config.DataDir, "tls")
+		return filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	}
+	return t.Cert, t.Key
+}
+
+// ensureSelfSigned creates a certificate for localhost and the base URL's
+// host on first run and keeps using it afterwards, so the browser exception
+// only has to be accepted once.
+func ensureSelfSigned(certFile, keyFile string) error {
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		return nil
+	} else if _, statErr := os.Stat(certFile); !errors.Is(statErr, os.ErrNotExist) {
+		return fmt.Errorf("existing self-signed certificate: %w", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"partyinvites development"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if u, err := url.Parse(config.BaseURL); err == nil && u.Hostname() != "localhost" {
+		if ip := net.ParseIP(u.Hostname()); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if u.Hostname() != "" {
+			template.DNSNames = append(template.DNSNames, u.Hostname())
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(certFile), 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return err
+	}
+	slog.Info("generated self-signed certificate", "cert", certFile, "hosts", template.DNSNames)
+	return nil
+}
+
+// strictTransport asks browsers to use only HTTPS for the site from now on.
+func strictTransport(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.TLS != nil && !config.TLS.SelfSigned && config.TLS.HSTSMaxAge > 0 {
+			writer.Header().Set("Strict-Transport-Security", fmt.Sprintf("max-age=%v", config.TLS.HSTSMaxAge))
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same path on the host of
+// the base URL, which must be an https URL when TLS is on. The request's Host
+// header is never used, so it cannot send guests elsewhere.
+func redirectToHTTPS(writer http.ResponseWriter, request *http.Request) {
+	target := &url.URL{Scheme: "https", Path: request.URL.Path, RawQuery: request.URL.RawQuery}
+	if base, err := url.Parse(config.BaseURL); err == nil {
+		target.Host = base.Host
+	}
+	http.Redirect(writer, request, target.String(), http.StatusMovedPermanently)
+}